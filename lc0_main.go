@@ -16,10 +16,12 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"regexp"
@@ -27,30 +29,82 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/LeelaChessZero/lczero-client/src/autotune"
+	"github.com/LeelaChessZero/lczero-client/src/backendopts"
+	"github.com/LeelaChessZero/lczero-client/src/book"
+	"github.com/LeelaChessZero/lczero-client/src/capabilities"
 	"github.com/LeelaChessZero/lczero-client/src/client"
+	"github.com/LeelaChessZero/lczero-client/src/crashloop"
+	"github.com/LeelaChessZero/lczero-client/src/health"
+	"github.com/LeelaChessZero/lczero-client/src/hooks"
+	"github.com/LeelaChessZero/lczero-client/src/lc0manager"
+	"github.com/LeelaChessZero/lczero-client/src/lc0version"
+	"github.com/LeelaChessZero/lczero-client/src/logging"
+	"github.com/LeelaChessZero/lczero-client/src/metrics"
+	"github.com/LeelaChessZero/lczero-client/src/netinfo"
+	"github.com/LeelaChessZero/lczero-client/src/policy"
+	"github.com/LeelaChessZero/lczero-client/src/stats"
+	"github.com/LeelaChessZero/lczero-client/src/status"
+	"github.com/LeelaChessZero/lczero-client/src/sysinfo"
+	"github.com/LeelaChessZero/lczero-client/src/tablebase"
+	"github.com/LeelaChessZero/lczero-client/src/trainingdata"
+	"github.com/LeelaChessZero/lczero-client/src/watchdog"
+	"github.com/LeelaChessZero/lczero-client/src/webhook"
 
 	"github.com/Tilps/chess"
 	"github.com/gofrs/flock"
 )
 
 var (
-	startTime       time.Time
-	totalGames      int
-	pendingNextGame *client.NextGameResponse
-	randId          int
-	hasCudnn        bool
-	hasCuda         bool
-	hasOpenCL       bool
-	hasEigen        bool
-	hasDx           bool
-	parallelism32   bool
-	testedDxNet     string
+	startTime     time.Time
+	totalGames    int
+	gamesMutex    sync.Mutex
+	randId        int
+	parallelism32 bool
+	// Books checked to be valid, by path, with the sha they had.
+	validBooks      = map[string]string{}
+	validBooksMutex sync.Mutex
+	// Matches the book file options, including per player ones.
+	bookParamRegex = regexp.MustCompile(`^--([\w-]+\.)?openings-(pgn|epd)=`)
+	shaRegex       = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	// Set to the tablebase directory once it is complete.
+	syzygyPath  string
+	syzygyMutex sync.Mutex
+	// Cached files the current game of each worker needs, these survive
+	// cache eviction.
+	inUseFiles = map[int][]string{}
+	cacheMutex sync.Mutex
+	// The network the dx12 backend was last checked with, per GPU.
+	testedDxNets = map[int]string{}
+	dxMutex      sync.Mutex
+	// What lc0 supports, and the backends to use from it, best first.
+	lc0Caps  *capabilities.Capabilities
+	backends []string
+	// Per GPU: how many backends it fell back past, whether it gave up the
+	// parallelism of 32, and the GPU reported to the server.
+	droppedBackends = map[int]int{}
+	no32            = map[int]bool{}
+	gpuTypes        = map[int]string{}
+	gpuMutex        sync.Mutex
+	// Set when running one worker per GPU.
+	multiGpu bool
+	// Locks of the claimed GPUs, kept until the client exits.
+	gpuLocks []*flock.Flock
+	// Rules for lc0 settings, if --policy is set.
+	policyFile *policy.File
+	// The device lc0 reports for each GPU, "" if probing it failed.
+	gpuDevices  = map[int]string{}
+	deviceMutex sync.Mutex
+	// Cache of tuned settings, if --autotune is set.
+	tuneStore *autotune.Store
+	// The installed lc0 versions, if --lc0-dir is set.
+	lc0Manager *lc0manager.Manager
 
 	lc0Exe           = "lc0"
 	defaultLocalHost = "Unknown"
-	gpuType          = "Unknown"
 
 	localHost     = flag.String("localhost", "", "Localhost name to send to the server when reporting\n(defaults to Unknown, overridden by the configuration file)")
 	hostname      = flag.String("hostname", "http://api.lczero.org", "Address of the server")
@@ -58,11 +112,17 @@ var (
 	user          = flag.String("user", "", "Username")
 	password      = flag.String("password", "", "Password")
 	gpu           = flag.Int("gpu", -1, "GPU to use (ignored if --backend-opts used)")
-	//	debug    = flag.Bool("debug", false, "Enable debug mode to see verbose output and save logs")
-	lc0Args  = flag.String("lc0args", "", "")
-	backopts = flag.String("backend-opts", "",
+	gpus          = flag.String("gpus", "", "Run games on several GPUs from this client: \"all\" or a list like 0,1,3")
+	gpuLockDir    = flag.String("gpu-lock-dir", filepath.Join(os.TempDir(), "lc0-training-client-gpus"), "Directory for the locks clients on this machine claim GPUs with when --gpu is not given\n(empty to let lc0 pick the GPU)")
+	debug         = flag.Bool("debug", false, "Enable debug mode to see verbose output and save logs")
+	lc0Args       = flag.String("lc0args", "", "")
+	backopts      = flag.String("backend-opts", "",
 		`Options for the lc0 mux. backend. Example: --backend-opts="cudnn(gpu=1)"`)
+	printOpts     = flag.Bool("print-backend-opts", false, "Print the backend options lc0 would get and exit")
 	parallel      = flag.Int("parallelism", -1, "Number of games to play in parallel (-1 for default)")
+	autotuneOn    = flag.Bool("autotune", false, "Find the parallelism and backend batch options playing the most games on this GPU\n(ignored if --parallelism or --backend-opts used)")
+	autotuneTrial = flag.Duration("autotune-trial", 5*time.Minute, "How long to try each configuration when tuning, after warming up")
+	autotunePath  = flag.String("autotune-cache", "", "File to keep tuning results in\n(defaults to lc0-training-client-autotune.json next to the configuration file)")
 	cacheDir      = flag.String("cache", "", "Directory to use for downloaded files cache (if it exists)")
 	useTestServer = flag.Bool("use-test-server", false, "Set host name to test server.")
 	runId         = flag.Uint("run", 0, "Which training run to contribute to (default 0 to let server decide)")
@@ -72,9 +132,156 @@ var (
 	report_host   = flag.Bool("report-host", false, "Send hostname to server for more fine-grained statistics")
 	report_gpu    = flag.Bool("report-gpu", false, "Send gpu info to server for more fine-grained statistics")
 	cudnn         = flag.Bool("cudnn", true, "Prefer the cudnn backend (if available)")
+	policyPath    = flag.String("policy", "", "JSON file with rules choosing the backend, backend options, parallelism and lc0 flags\nby GPU, lc0 version, network architecture and OS")
+	priority      = flag.String("backend-priority", "cudnn-auto,cuda-auto,dx12,opencl", "Backends to use if lc0 supports them, best first\n(ignored if --backend-opts used)")
 	settingsPath  = flag.String("config", "", "JSON configuration file to use")
+	syzygyDir     = flag.String("syzygy-dir", "", "Directory to keep Syzygy tablebases in for games that use them\n(empty to not provide tablebases)")
+	syzygyPieces  = flag.Int("syzygy-pieces", 5, "Largest number of pieces of the tablebases to provide")
+	syzygyMirrors = flag.String("syzygy-mirrors", "", "Comma separated url prefixes to download tablebases from")
+	syzygyList    = flag.String("syzygy-manifest", "", "Path or url of the tablebase checksum list\n(defaults to SHA256SUMS on the first mirror)")
+	minFreeDisk   = flag.Int("min-free-disk", 1024, "Pause work while less than this many MB are free for the cache or training data")
+	minFreeMemory = flag.Int("min-free-memory", 256, "Pause work while less than this many MB of memory are available (Linux only)")
+	metricsAddr   = flag.String("metrics-addr", "", "Address to serve Prometheus metrics on, e.g. localhost:9100 (empty to disable)")
+	logLevel      = flag.String("log-level", "info", "Lowest level to log: debug, info, warn or error")
+	logJSON       = flag.Bool("log-json", false, "Log JSON lines instead of text")
+	lc0Output     = flag.String("lc0-output", "", "Where to write raw lc0 output: \"stdout\", \"stderr\" or a file\n(empty to log it with the engine component)")
+	logDir        = flag.String("log-dir", "", "Directory to save client logs and lc0 transcripts in (empty to not save them)")
+	logMaxSize    = flag.Int("log-max-size", 10, "Rotate the saved client log once it reaches this many MB")
+	logMaxAge     = flag.Duration("log-max-age", 24*time.Hour, "Rotate the saved client log once it is this old")
+	logKeep       = flag.Int("log-keep", 10, "Number of rotated client logs and of lc0 transcripts to keep")
+	transcripts   = flag.Bool("lc0-transcripts", false, "Save the command line, full output and exit status of every lc0 launch in --log-dir")
+	statsPath     = flag.String("stats", "", "File to keep lifetime contribution statistics in\n(defaults to lc0-training-client-stats.json next to the configuration file)")
+	statusAddr    = flag.String("status-addr", "", "Address to serve the status API and dashboard on, e.g. localhost:8080\n(empty to disable)")
+	hookTimeout   = flag.Duration("hook-timeout", 30*time.Second, "Kill hook commands that run longer than this")
+	webhookPeriod = flag.Duration("webhook-interval", 30*time.Minute, "Least time between two webhook notifications of the same kind")
+	stallTimeout  = flag.Duration("stall-timeout", 30*time.Minute, "Restart lc0 when it prints nothing for this long\n(less once the usual time between games is known)")
+	maxBackoff    = flag.Duration("max-backoff", 15*time.Minute, "Longest wait before trying again after errors")
+	fallback      = flag.Bool("backend-fallback", false, "Switch to the next backend when lc0 keeps failing with the current one\n(ignored if --backend-opts used)")
+	healthAddr    = flag.String("health-addr", "", "Address to serve /healthz and /readyz on, e.g. localhost:8099 (empty to disable)")
+	readyGrace    = flag.Duration("health-lc0-grace", 5*time.Minute, "How long lc0 may be down while the client is not downloading, sleeping or tuning before /readyz fails")
+	checkInterval = flag.Duration("self-check-interval", 24*time.Hour, "Compare the results of the GPU backend with a CPU backend between games this often (0 to disable)")
+	checkRef      = flag.String("self-check-reference", "", "Backend to compare with in self checks (default lc0's choice of eigen or blas)")
+	checkStop     = flag.Bool("self-check-stop", false, "Exit when a periodic self check fails, instead of reporting it and carrying on")
+	spotGames     = flag.Int("spot-check-games", 100, "Replay positions of one in this many selfplay games on the CPU, to compare with the training data (0 to disable)")
+	spotPositions = flag.Int("spot-check-positions", 8, "How many positions of a game spot checks replay")
+	spotValueTol  = flag.Float64("spot-check-value-tolerance", 0.1, "Largest difference of the network value between the training data and the CPU in spot checks")
+	spotPolicyTol = flag.Float64("spot-check-policy-tolerance", 0.25, "Largest difference of the policy divergence between the training data and the CPU in spot checks")
+	serverTimeout = flag.Duration("health-server-timeout", 15*time.Minute, "Report not ready when the server could not be reached for this long")
+	lc0Dir        = flag.String("lc0-dir", "", "Directory to install lc0 versions in and run the current one from\n(empty to run the lc0 in the working directory or on the PATH)")
+	lc0Releases   = flag.String("lc0-releases", "", "Directory or url with lc0 release archives and their SHA256SUMS, for --lc0-dir")
+	lc0Variant    = flag.String("lc0-variant", runtime.GOOS, "Which lc0 release archives to use, e.g. linux or windows-gpu-nvidia-cuda")
+	lc0Source     = flag.String("lc0-source", "", "lc0 source tree to build with meson and ninja when no release fits, for --lc0-dir")
+	lc0Keep       = flag.Int("lc0-keep", 2, "Older lc0 versions to keep in --lc0-dir besides the previous one (0 to keep all)")
+)
+
+var (
+	clientLog    = logging.New("client")
+	engineLog    = logging.New("engine")
+	uploaderLog  = logging.New("uploader")
+	cacheLog     = logging.New("cache")
+	schedulerLog = logging.New("scheduler")
 )
 
+var (
+	gamesCompleted = metrics.NewCounter("lczero_client_games_completed_total",
+		"Games finished by lc0.", "type", "run", "network")
+	gamesUploaded = metrics.NewCounter("lczero_client_games_uploaded_total",
+		"Games uploaded to the server.", "type", "run", "network")
+	gamesFailed = metrics.NewCounter("lczero_client_games_failed_total",
+		"Games that failed to upload.", "type", "run", "network")
+	uploadDuration = metrics.NewHistogram("lczero_client_upload_duration_seconds",
+		"Time taken by game uploads.", metrics.ExponentialBuckets(0.05, 2, 12))
+	uploadBytes = metrics.NewCounter("lczero_client_upload_bytes_total",
+		"Bytes sent in game uploads.")
+	downloadDuration = metrics.NewHistogram("lczero_client_download_duration_seconds",
+		"Time taken by downloads.", metrics.ExponentialBuckets(0.1, 2, 14), "kind")
+	downloadBytes = metrics.NewCounter("lczero_client_download_bytes_total",
+		"Size of the files downloaded.", "kind")
+	lc0Restarts = metrics.NewCounter("lczero_client_lc0_restarts_total",
+		"Times lc0 was started again after the first launch.")
+	lc0Retries = metrics.NewCounter("lczero_client_retries_total",
+		"Times lc0 was restarted with different settings.")
+	selfChecks = metrics.NewCounter("lczero_client_self_checks_total",
+		"Backend self checks run, by result.", "backend", "result")
+	spotChecks = metrics.NewCounter("lczero_client_spot_checks_total",
+		"Selfplay positions spot checked on the CPU, by result of the check.", "result")
+	lc0Stalls = metrics.NewCounter("lczero_client_lc0_stalls_total",
+		"Times lc0 was killed for printing nothing for too long.")
+	networkIdGauge = metrics.NewGauge("lczero_client_network_id",
+		"Id of the network in use.")
+	parallelismGauge = metrics.NewGauge("lczero_client_parallelism",
+		"Parallelism given to lc0, 0 for its default.", "gpu")
+	backendInfo = metrics.NewGauge("lczero_client_backend_info",
+		"Backend options given to lc0.", "gpu", "backend")
+	fpThresholds = metrics.NewHistogram("lczero_client_resign_fp_threshold",
+		"Resign thresholds that would have given false positives.",
+		[]float64{0.5, 1, 2, 3, 4, 5, 7.5, 10, 15, 20, 30, 50, 100})
+	httpMuxes  = map[string]*http.ServeMux{}
+	statsStore *stats.Store
+	// Games in a row that failed to upload.
+	uploadFailures      int
+	uploadFailuresMutex sync.Mutex
+	// The running lc0 processes.
+	runningLc0    = map[*cmdWrapper]bool{}
+	lc0Launched   bool
+	progressMutex sync.Mutex
+	// When lc0 was last seen running, and how many workers are downloading,
+	// sleeping or tuning instead.
+	lc0LastRunning = time.Now()
+	awayFromLc0    int
+	// Learned game timings per game type.
+	gameHistories = map[string]*watchdog.History{}
+	// When the server last answered.
+	lastContact  time.Time
+	contactMutex sync.Mutex
+	// The lc0 versions the server asked for last.
+	serverReq      lc0version.Requirement
+	serverReqMutex sync.Mutex
+	// Set while a spot check runs, to run one at a time.
+	spotBusy  bool
+	spotMutex sync.Mutex
+)
+
+// Run the upload failed hooks after this many failed games in a row.
+const uploadFailureLimit = 3
+
+// Notify the webhooks after this many errors in a row in the main loop.
+const repeatedErrorLimit = 5
+
+// Summarize lc0 failures after this many in a row.
+const crashLoopLimit = 5
+
+// How many of the last lc0 output lines are kept to classify failures.
+const tailLines = 20
+
+// Most GPUs --gpus=all looks for.
+const maxGpus = 16
+
+// Never consider lc0 stalled after less quiet time than this.
+const minStallTimeout = 5 * time.Minute
+
+// hookFlag adds a hook each time --hook is given.
+type hookFlag struct{}
+
+func (hookFlag) String() string {
+	return ""
+}
+
+func (hookFlag) Set(spec string) error {
+	return hooks.Add(spec)
+}
+
+// webhookFlag adds a webhook target each time --webhook is given.
+type webhookFlag struct{}
+
+func (webhookFlag) String() string {
+	return ""
+}
+
+func (webhookFlag) Set(spec string) error {
+	return webhook.Add(spec)
+}
+
 // Settings holds username and password.
 type Settings struct {
 	User      string
@@ -98,7 +305,7 @@ func readSettings(path string) (string, string, string) {
 	decoder := json.NewDecoder(file)
 	err = decoder.Decode(&settings)
 	if err != nil {
-		log.Fatal("Error decoding JSON ", err)
+		clientLog.Fatalf("Error decoding JSON: %v", err)
 		return "", "", ""
 	}
 	return settings.User, settings.Pass, settings.Localhost
@@ -119,13 +326,13 @@ func createSettings(path string) (string, string) {
 	fmt.Scanf("%s\n", &settings.Pass)
 	jsonSettings, err := json.Marshal(settings)
 	if err != nil {
-		log.Fatal("Cannot encode settings to JSON ", err)
+		clientLog.Fatalf("Cannot encode settings to JSON: %v", err)
 		return "", ""
 	}
 	settingsFile, err := os.Create(path)
 	defer settingsFile.Close()
 	if err != nil {
-		log.Fatal("Could not create output file ", err)
+		clientLog.Fatalf("Could not create output file: %v", err)
 		return "", ""
 	}
 	settingsFile.Write(jsonSettings)
@@ -140,13 +347,42 @@ func getExtraParams() map[string]string {
 		"token":      strconv.Itoa(randId),
 		"train_only": strconv.FormatBool(*trainOnly),
 		"hostname":   *localHost,
-		"gpu":        gpuType,
+		"gpu":        gpuTypeOf(*gpu),
 		"gpu_id":     strconv.Itoa(*gpu),
 	}
 }
 
+// extraParamsFor returns the parameters sent to the server for a worker
+// using gpu.
+func extraParamsFor(gpu int) map[string]string {
+	params := getExtraParams()
+	params["gpu"] = gpuTypeOf(gpu)
+	params["gpu_id"] = strconv.Itoa(gpu)
+	return params
+}
+
+// gpuTypeOf returns the GPU reported to the server for gpu.
+func gpuTypeOf(gpu int) string {
+	gpuMutex.Lock()
+	defer gpuMutex.Unlock()
+	if t, ok := gpuTypes[gpu]; ok {
+		return t
+	}
+	return "Unknown"
+}
+
+// setGpuType sets the GPU reported to the server for gpu, if enabled.
+func setGpuType(gpu int, t string) {
+	if !*report_gpu || *backopts != "" {
+		return
+	}
+	gpuMutex.Lock()
+	gpuTypes[gpu] = t
+	gpuMutex.Unlock()
+}
+
 func uploadGame(httpClient *http.Client, path string, pgn string,
-	nextGame client.NextGameResponse, version string, fp_threshold float64) error {
+	nextGame client.NextGameResponse, version string, fp_threshold float64, gpu int) error {
 
 	var retryCount uint32
 
@@ -156,7 +392,7 @@ func uploadGame(httpClient *http.Client, path string, pgn string,
 			return errors.New("UploadGame failed: Too many retries")
 		}
 
-		extraParams := getExtraParams()
+		extraParams := extraParamsFor(gpu)
 		extraParams["training_id"] = strconv.Itoa(int(nextGame.TrainingId))
 		extraParams["network_id"] = strconv.Itoa(int(nextGame.NetworkId))
 		extraParams["pgn"] = pgn
@@ -166,49 +402,220 @@ func uploadGame(httpClient *http.Client, path string, pgn string,
 		}
 		request, err := client.BuildUploadRequest(*hostname+"/upload_game", extraParams, "file", path)
 		if err != nil {
-			log.Printf("BUR: %v", err)
+			uploaderLog.Errorf("BUR: %v", err)
 			return err
 		}
+		uploadStart := time.Now()
 		resp, err := httpClient.Do(request)
 		if err != nil {
-			log.Printf("http.Do: %v", err)
+			uploaderLog.Errorf("http.Do: %v", err)
 			return err
 		}
 		body := &bytes.Buffer{}
 		_, err = body.ReadFrom(resp.Body)
+		uploadDuration.Observe(time.Since(uploadStart).Seconds())
+		uploadBytes.Add(float64(request.ContentLength))
 		if err != nil {
-			log.Print(err)
-			log.Print("Error uploading, retrying...")
+			uploaderLog.Errorf("%v", err)
+			uploaderLog.Warnf("Error uploading, retrying...")
 			time.Sleep(time.Second * (2 << retryCount))
 			continue
 		}
 		resp.Body.Close()
 		if resp.StatusCode != 200 && strings.Contains(body.String(), " upgrade ") {
-			log.Printf("The lc0 version you are using is not accepted by the server")
-			if strings.Contains(version, "dev") {
-				log.Printf("It is an unreleased development version")
-			} else if strings.Contains(version, "rc") {
-				log.Printf("It is a release candidate")
+			uploaderLog.Errorf("The lc0 version you are using is not accepted by the server")
+			if p := lc0version.Prerelease(version); p != "" {
+				uploaderLog.Errorf("It is %s", p)
 			}
-			log.Printf("You probably need the latest release")
-			os.Exit(5)
+			uploaderLog.Errorf("You probably need the latest release")
+			upgradeLc0(version, "", fmt.Sprintf("The server no longer accepts lc0 %s, the client exited", version))
 		}
 		break
 	}
 
+	gamesMutex.Lock()
 	totalGames++
+	games := totalGames
+	gamesMutex.Unlock()
+	status.Update(func(s *status.Status) {
+		s.GamesSinceStart = games
+	})
 	var duration = time.Since(startTime)
-	var speed = int(float64(totalGames) / duration.Hours() * 24)
-	log.Printf("Completed %d games in %s time (%d games/day)", totalGames, duration, speed)
+	var speed = int(float64(games) / duration.Hours() * 24)
+	uploaderLog.Infof("Completed %d games in %s time (%d games/day)", games, duration, speed)
+	recordStats(nextGame, version, 0)
 
 	err := os.Remove(path)
 	if err != nil {
-		log.Printf("Failed to remove training file: %v", err)
+		uploaderLog.Warnf("Failed to remove training file: %v", err)
 	}
 
 	return nil
 }
 
+// recordStats adds an uploaded game to the lifetime statistics. For matches
+// result is the game result from the candidate's point of view.
+func recordStats(ngr client.NextGameResponse, version string, result int) {
+	if statsStore == nil {
+		return
+	}
+	r := stats.Record{
+		Day:        stats.Day(time.Now()),
+		Type:       ngr.Type,
+		Run:        ngr.TrainingId,
+		Network:    ngr.NetworkId,
+		Lc0Version: version,
+		Games:      1,
+	}
+	if ngr.Type == "match" {
+		switch result {
+		case 1:
+			r.Wins = 1
+		case -1:
+			r.Losses = 1
+		default:
+			r.Draws = 1
+		}
+	}
+	if err := statsStore.Add(r); err != nil {
+		uploaderLog.Warnf("Unable to update statistics: %v", err)
+		return
+	}
+	records, err := statsStore.Load()
+	if err != nil {
+		return
+	}
+	lifetime, today := 0, 0
+	for _, rec := range records {
+		lifetime += rec.Games
+		if rec.Day == r.Day {
+			today += rec.Games
+		}
+	}
+	uploaderLog.Infof("Lifetime: %d games, %d today", lifetime, today)
+}
+
+func printSummaries(title string, records []stats.Record, key func(r stats.Record) string) {
+	fmt.Printf("%s:\n", title)
+	for _, s := range stats.Summarize(records, key) {
+		if s.Wins+s.Losses+s.Draws > 0 {
+			fmt.Printf("  %-24s %8d games (match +%d -%d =%d)\n", s.Key, s.Games, s.Wins, s.Losses, s.Draws)
+		} else {
+			fmt.Printf("  %-24s %8d games\n", s.Key, s.Games)
+		}
+	}
+}
+
+// openLc0Manager sets lc0Manager up for --lc0-dir.
+func openLc0Manager() *lc0manager.Manager {
+	var err error
+	config := lc0manager.Config{Releases: *lc0Releases, Variant: *lc0Variant, Source: *lc0Source, Keep: *lc0Keep}
+	lc0Manager, err = lc0manager.Open(*lc0Dir, &http.Client{Timeout: 30 * time.Minute}, config)
+	if err != nil {
+		clientLog.Fatalf("Unable to use --lc0-dir: %v", err)
+	}
+	return lc0Manager
+}
+
+// runLc0Command lists, updates or rolls back the lc0 versions in --lc0-dir.
+func runLc0Command(args []string) int {
+	if *lc0Dir == "" {
+		fmt.Fprintf(os.Stderr, "The lc0 command needs --lc0-dir\n")
+		return 1
+	}
+	m := openLc0Manager()
+	switch strings.Join(args, " ") {
+	case "", "list":
+		list, err := m.List()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		for _, v := range list {
+			var marks []string
+			if v.Current {
+				marks = append(marks, "current")
+			}
+			if v.Previous {
+				marks = append(marks, "previous")
+			}
+			if v.Rejected {
+				marks = append(marks, "refused by the server")
+			}
+			if v.Pinned {
+				marks = append(marks, "rolled back to, kept until lc0 update")
+			}
+			if len(marks) > 0 {
+				fmt.Printf("%s (%s)\n", v.Version, strings.Join(marks, ", "))
+			} else {
+				fmt.Printf("%s\n", v.Version)
+			}
+		}
+	case "update":
+		if err := m.Unpin(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		exe, err := m.Update(lc0version.Builtin.Minimum)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		fmt.Printf("%s\n", exe)
+	case "rollback":
+		version, err := m.Rollback()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to roll back: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Switched to lc0 %s\n", version)
+	default:
+		fmt.Fprintf(os.Stderr, "Usage: lc0 [list|update|rollback]\n")
+		return 1
+	}
+	return 0
+}
+
+// runStats implements the stats subcommand, printing summaries of the
+// lifetime statistics or exporting them as CSV.
+func runStats(args []string) int {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	csvOut := fs.Bool("csv", false, "Print all records as CSV")
+	days := fs.Int("days", 30, "Number of days to show per day totals for")
+	fs.Parse(args)
+
+	records, err := statsStore.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read statistics: %v\n", err)
+		return 1
+	}
+	if *csvOut {
+		if err := stats.WriteCSV(os.Stdout, records); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		return 0
+	}
+	if len(records) == 0 {
+		fmt.Printf("No games recorded in %s yet\n", *statsPath)
+		return 0
+	}
+	printSummaries("Total", records, func(r stats.Record) string { return r.Type })
+	var recent []stats.Record
+	since := stats.Day(time.Now().AddDate(0, 0, -*days+1))
+	for _, r := range records {
+		if r.Day >= since {
+			recent = append(recent, r)
+		}
+	}
+	printSummaries(fmt.Sprintf("Last %d days", *days), recent, func(r stats.Record) string { return r.Day })
+	printSummaries("Month", records, func(r stats.Record) string { return r.Day[:7] })
+	printSummaries("Run", records, func(r stats.Record) string { return fmt.Sprintf("%d", r.Run) })
+	printSummaries("Network", records, func(r stats.Record) string { return fmt.Sprintf("%d", r.Network) })
+	printSummaries("Lc0 version", records, func(r stats.Record) string { return r.Lc0Version })
+	return 0
+}
+
 type gameInfo struct {
 	pgn   string
 	fname string
@@ -218,6 +625,8 @@ type gameInfo struct {
 	fp_threshold float64
 	player1      string
 	result       string
+	// The moves as lc0 sent them, for spot checks.
+	moves []string
 }
 
 type cmdWrapper struct {
@@ -228,13 +637,207 @@ type cmdWrapper struct {
 	gi       chan gameInfo
 	Version  string
 	Retry    chan bool
+	// Set when lc0 is killed on purpose.
+	killed bool
+	// Notices when lc0 hangs, if set.
+	watch *watchdog.Watch
+	// Full record of the lc0 run, if enabled.
+	transcript      *os.File
+	transcriptMutex sync.Mutex
+	readDone        chan bool
+	// The last lines lc0 printed.
+	tail []string
+	// GPU to use, -1 for lc0's default.
+	gpu int
+	// Tuned settings to use instead of the defaults, if any.
+	tuned *autotune.Config
+}
+
+// lc0Failure is returned when lc0 exits without producing any games.
+type lc0Failure struct {
+	what   string
+	cause  crashloop.Cause
+	status string
+	tail   []string
+}
+
+func (e *lc0Failure) Error() string {
+	if e.cause == crashloop.Stalled {
+		return "lc0 stalled"
+	}
+	return fmt.Sprintf("Client self-exited without producing any %s: %s (%s)", e.what, e.cause, e.status)
+}
+
+// kill stops lc0 on purpose, so its exit is not taken for a crash.
+func (c *cmdWrapper) kill() {
+	c.killed = true
+	c.Cmd.Process.Kill()
+}
+
+func (c *cmdWrapper) openTranscript() {
+	if !*transcripts {
+		return
+	}
+	name := fmt.Sprintf("lc0-%s.log", time.Now().Format("20060102-150405.000"))
+	if multiGpu {
+		name = fmt.Sprintf("lc0-%s-gpu%d.log", time.Now().Format("20060102-150405.000"), c.gpu)
+	}
+	file, err := os.Create(filepath.Join(*logDir, name))
+	if err != nil {
+		engineLog.Warnf("Unable to create lc0 transcript: %v", err)
+		return
+	}
+	logging.Prune(*logDir, "lc0-", *logKeep)
+	c.transcript = file
+	c.writeTranscript(fmt.Sprintf("Started: %s", time.Now().Format(time.RFC3339)))
+	c.writeTranscript(fmt.Sprintf("Command: %s", strings.Join(c.Cmd.Args, " ")))
+}
+
+// addTail keeps line among the last lines lc0 printed.
+func (c *cmdWrapper) addTail(line string) {
+	c.transcriptMutex.Lock()
+	defer c.transcriptMutex.Unlock()
+	c.tail = append(c.tail, line)
+	if len(c.tail) > tailLines {
+		c.tail = c.tail[len(c.tail)-tailLines:]
+	}
+}
+
+// failure describes lc0 exiting with err before producing any of what.
+func (c *cmdWrapper) failure(err error, what string) *lc0Failure {
+	c.transcriptMutex.Lock()
+	tail := append([]string(nil), c.tail...)
+	c.transcriptMutex.Unlock()
+	status := "exit status 0"
+	if err != nil {
+		status = err.Error()
+	}
+	return &lc0Failure{what: what, cause: crashloop.Classify(tail, err), status: status, tail: tail}
+}
+
+// stallFailure describes lc0 being killed for printing nothing, so that
+// stalls count towards crash loops.
+func (c *cmdWrapper) stallFailure(what string) *lc0Failure {
+	c.transcriptMutex.Lock()
+	tail := append([]string(nil), c.tail...)
+	c.transcriptMutex.Unlock()
+	return &lc0Failure{what: what, cause: crashloop.Stalled, status: "killed after stalling", tail: tail}
+}
+
+func (c *cmdWrapper) writeTranscript(line string) {
+	c.transcriptMutex.Lock()
+	defer c.transcriptMutex.Unlock()
+	if c.transcript != nil {
+		io.WriteString(c.transcript, line+"\n")
+	}
+}
+
+// setRunning records whether lc0 is running.
+func (c *cmdWrapper) setRunning(running bool) {
+	progressMutex.Lock()
+	if running {
+		runningLc0[c] = true
+	} else {
+		delete(runningLc0, c)
+	}
+	lc0LastRunning = time.Now()
+	progressMutex.Unlock()
+}
+
+// stepAway records that a worker is busy with something other than running
+// lc0 until the returned function is called.
+func stepAway() func() {
+	progressMutex.Lock()
+	awayFromLc0++
+	progressMutex.Unlock()
+	return func() {
+		progressMutex.Lock()
+		awayFromLc0--
+		lc0LastRunning = time.Now()
+		progressMutex.Unlock()
+	}
+}
+
+// startWatch starts watching lc0 for stalls, using the game timings learned
+// for gameType.
+func (c *cmdWrapper) startWatch(gameType string) {
+	progressMutex.Lock()
+	history, ok := gameHistories[gameType]
+	if !ok {
+		history = &watchdog.History{}
+		gameHistories[gameType] = history
+	}
+	progressMutex.Unlock()
+	c.watch = history.Start(minStallTimeout, *stallTimeout)
+}
+
+// checkStall kills lc0 if it has been quiet for too long, and reports
+// whether it did.
+func checkStall(c *cmdWrapper, ngr client.NextGameResponse) bool {
+	if c.watch == nil || c.killed {
+		return false
+	}
+	stalled, since := c.watch.Stalled()
+	if !stalled {
+		return false
+	}
+	msg := fmt.Sprintf("lc0 printed nothing since %s, restarting it", since.Format(time.RFC3339))
+	engineLog.Errorf("%s", msg)
+	lc0Stalls.Inc()
+	webhook.Send(webhook.Stall, msg, gameData(ngr))
+	data := gameData(ngr)
+	data["error"] = "stalled"
+	data["command"] = strings.Join(c.Cmd.Args, " ")
+	hooks.Run(hooks.Lc0Crashed, data)
+	c.kill()
+	return true
+}
+
+// killAll stops all running lc0 processes.
+func killAll() {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+	for c := range runningLc0 {
+		c.kill()
+	}
+}
+
+// markServerContact records that the server answered.
+func markServerContact() {
+	contactMutex.Lock()
+	lastContact = time.Now()
+	contactMutex.Unlock()
+}
+
+// wait waits for lc0 to exit, recording the exit status in the transcript.
+func (c *cmdWrapper) wait() error {
+	err := c.Cmd.Wait()
+	c.setRunning(false)
+	// Give the reader a moment to copy the last lines.
+	select {
+	case <-c.readDone:
+	case <-time.After(5 * time.Second):
+	}
+	if c.transcript == nil {
+		return err
+	}
+	exitStatus := "0"
+	if err != nil {
+		exitStatus = err.Error()
+	}
+	c.writeTranscript(fmt.Sprintf("Exited: %s with status %s", time.Now().Format(time.RFC3339), exitStatus))
+	c.transcriptMutex.Lock()
+	c.transcript.Close()
+	c.transcript = nil
+	c.transcriptMutex.Unlock()
+	return err
 }
 
 func (c *cmdWrapper) openInput() {
 	var err error
 	c.Input, err = c.Cmd.StdinPipe()
 	if err != nil {
-		log.Fatal(err)
+		engineLog.Fatalf("%v", err)
 	}
 }
 
@@ -254,7 +857,7 @@ func convertMovesToPGN(moves []string, result string, start_ply_count int) strin
 	for _, m := range moves {
 		err := game.MoveStr(m)
 		if err != nil {
-			log.Fatalf("movstr: %v", err)
+			engineLog.Fatalf("movstr: %v", err)
 		}
 	}
 	if game.Outcome() == chess.NoOutcome && len(game.EligibleDraws()) > 1 {
@@ -263,7 +866,7 @@ func convertMovesToPGN(moves []string, result string, start_ply_count int) strin
 	game2 := chess.NewGame()
 	b, err := game.MarshalText()
 	if err != nil {
-		log.Fatalf("MarshalText failed: %v", err)
+		engineLog.Fatalf("MarshalText failed: %v", err)
 	}
 	b_str := string(b)
 	if strings.HasSuffix(b_str, " *") && result != "" {
@@ -285,156 +888,745 @@ func createCmdWrapper() *cmdWrapper {
 		BestMove: make(chan string),
 		Version:  "v0.10.0",
 		Retry:    make(chan bool),
+		readDone: make(chan bool),
+		gpu:      *gpu,
 	}
 	return c
 }
 
+// setDevice shows the device lc0 reports using in the status.
+func (c *cmdWrapper) setDevice(device string) {
+	deviceMutex.Lock()
+	gpuDevices[c.gpu] = device
+	deviceMutex.Unlock()
+	status.Update(func(s *status.Status) {
+		s.Gpu = device
+	})
+	if multiGpu {
+		status.UpdateWorker(c.gpu, func(w *status.Worker) {
+			w.Device = device
+		})
+	}
+}
+
+// gpuLabel is the gpu label of per-GPU metrics, empty if lc0 picks the GPU.
+func gpuLabel(gpu int) string {
+	if gpu < 0 {
+		return ""
+	}
+	return strconv.Itoa(gpu)
+}
+
+// setBackend shows the backend lc0 is launched with in the metrics and the
+// status.
+func (c *cmdWrapper) setBackend(backend string) {
+	backendInfo.ResetMatching("gpu", gpuLabel(c.gpu))
+	backendInfo.Set(1, gpuLabel(c.gpu), backend)
+	if multiGpu {
+		status.UpdateWorker(c.gpu, func(w *status.Worker) {
+			w.Backend = backend
+		})
+		return
+	}
+	status.Update(func(s *status.Status) {
+		s.Backend = backend
+	})
+}
+
+// engineLine handles a line of lc0 output, telling GPUs apart if there are
+// several.
+func (c *cmdWrapper) engineLine(level logging.Level, line string) {
+	if multiGpu {
+		line = fmt.Sprintf("gpu %d: %s", c.gpu, line)
+	}
+	logging.EngineLine(level, line)
+}
+
+// gameLabels returns the metrics labels for a game of ngr.
+func gameLabels(ngr client.NextGameResponse) []string {
+	return []string{ngr.Type, strconv.Itoa(int(ngr.TrainingId)), strconv.Itoa(int(ngr.NetworkId))}
+}
+
+// gameData returns the hook event data describing a game of ngr.
+func gameData(ngr client.NextGameResponse) map[string]interface{} {
+	return map[string]interface{}{
+		"type":          ngr.Type,
+		"run":           ngr.TrainingId,
+		"network_id":    ngr.NetworkId,
+		"sha":           ngr.Sha,
+		"candidate_sha": ngr.CandidateSha,
+	}
+}
+
+// reportUpload counts an uploaded or failed game of ngr and runs the hooks
+// for it.
+func reportUpload(ngr client.NextGameResponse, result string, err error) {
+	uploadFailuresMutex.Lock()
+	defer uploadFailuresMutex.Unlock()
+	data := gameData(ngr)
+	if err != nil {
+		gamesFailed.Inc(gameLabels(ngr)...)
+		uploadFailures++
+		if uploadFailures%uploadFailureLimit == 0 {
+			data["failures"] = uploadFailures
+			data["error"] = err.Error()
+			hooks.Run(hooks.UploadFailed, data)
+		}
+		return
+	}
+	uploadFailures = 0
+	markServerContact()
+	gamesUploaded.Inc(gameLabels(ngr)...)
+	data["result"] = result
+	hooks.Run(hooks.GameUploaded, data)
+}
+
+// checkCrash runs the lc0 crashed hooks if lc0 exited with an error without
+// being killed.
+func checkCrash(c *cmdWrapper, ngr client.NextGameResponse, err error) {
+	if err == nil || c.killed {
+		return
+	}
+	data := gameData(ngr)
+	data["error"] = err.Error()
+	data["command"] = strings.Join(c.Cmd.Args, " ")
+	hooks.Run(hooks.Lc0Crashed, data)
+}
+
 func checkLc0() {
-	cmd := exec.Command(lc0Exe)
-	cmd.Args = append(cmd.Args, "--help")
-	out, err := cmd.CombinedOutput()
+	caps, err := capabilities.Probe(lc0Exe)
 	if err != nil {
-		log.Fatal(err)
+		engineLog.Fatalf("%v", err)
+	}
+	lc0Caps = caps
+	status.Update(func(s *status.Status) {
+		s.Lc0Version = caps.Version
+	})
+	checkLc0Version(lc0version.Builtin)
+	if p := lc0version.Prerelease(caps.Version); p != "" {
+		engineLog.Warnf("lc0 %s is %s, the server may not accept its games", caps.Version, p)
+	}
+	var wanted []string
+	for _, b := range strings.Split(*priority, ",") {
+		b = strings.TrimSpace(b)
+		if b == "" || (strings.HasPrefix(b, "cudnn") && !*cudnn) {
+			continue
+		}
+		if !backendopts.AllowedBackend(b) {
+			clientLog.Fatalf("The %s backend in --backend-priority is not allowed", b)
+		}
+		wanted = append(wanted, b)
+	}
+	backends = caps.Select(wanted)
+	for _, b := range backends {
+		if b == "cudnn-auto" || b == "cuda-auto" {
+			parallelism32 = true
+		}
+	}
+	engineLog.Infof("Found %v", caps)
+	if *backopts == "" {
+		engineLog.Infof("Using the %s backend", backendName(*gpu))
 	}
-	if bytes.Contains(out, []byte("eigen")) {
-		hasEigen = true
+}
+
+// upgradeLc0 notifies the webhooks and hooks that lc0 needs an upgrade, and
+// exits with code 5, on which client.sh updates lc0. minimum is the version
+// lc0 must at least have, empty if the server refused this version.
+func upgradeLc0(version string, minimum string, msg string) {
+	data := map[string]interface{}{"component": "lc0", "version": version, "reason": "outdated", "minimum": minimum}
+	if minimum == "" {
+		data["reason"] = "refused"
+	}
+	if lc0Manager != nil {
+		// Only versions the server refused are marked, others are replaced
+		// for being older than the minimum.
+		var err error
+		if minimum == "" {
+			minimum = lc0version.Builtin.Minimum
+			err = lc0Manager.RejectCurrent()
+		}
+		if err != nil {
+			engineLog.Warnf("Unable to mark lc0 %s as refused: %v", version, err)
+		} else if exe, err := lc0Manager.Update(minimum); err != nil {
+			engineLog.Warnf("Unable to install a newer lc0: %v", err)
+		} else if exe != lc0Exe {
+			engineLog.Infof("Installed a newer lc0, it is used when the client starts again")
+		} else {
+			engineLog.Warnf("No newer lc0 is available in --lc0-releases or --lc0-source")
+		}
 	}
-	if bytes.Contains(out, []byte("dx12")) {
-		hasDx = true
+	webhook.SendAndWait(webhook.UpgradeRequired, msg, nil)
+	hooks.RunAndWait(hooks.UpgradeRequired, data)
+	hooks.Exit(5, "upgrade required")
+}
+
+// checkLc0Version exits asking for an upgrade if lc0 is older than req
+// allows, before GPU time is spent on games that would be rejected.
+func checkLc0Version(req lc0version.Requirement) {
+	warning, err := req.Check(lc0Caps.Version)
+	if err != nil {
+		engineLog.Errorf("%v", err)
+		engineLog.Errorf("Get the latest release from https://github.com/LeelaChessZero/lc0/releases")
+		upgradeLc0(lc0Caps.Version, req.Minimum, fmt.Sprintf("%v, the client exited", err))
 	}
-	if bytes.Contains(out, []byte("cuda-auto")) {
-		hasCuda = true
-		parallelism32 = true
+	if warning != "" {
+		engineLog.Warnf("%s", warning)
 	}
-	if bytes.Contains(out, []byte("cudnn-auto")) && *cudnn {
-		hasCudnn = true
-		parallelism32 = true
+}
+
+// checkServerLc0Version checks lc0 against the versions the server asks for,
+// whenever they change.
+func checkServerLc0Version(ngr client.NextGameResponse) {
+	req := lc0version.Requirement{Minimum: ngr.MinLc0Version, Recommended: ngr.RecommendedLc0Version, Source: "the server"}
+	serverReqMutex.Lock()
+	defer serverReqMutex.Unlock()
+	if req == serverReq {
+		return
 	}
-	if bytes.Contains(out, []byte("opencl")) {
-		hasOpenCL = true
+	serverReq = req
+	checkLc0Version(req)
+}
+
+// selectedBackend returns the backend launch uses on gpu unless
+// --backend-opts is given, "default" to let lc0 choose.
+func selectedBackend(gpu int) string {
+	gpuMutex.Lock()
+	dropped := droppedBackends[gpu]
+	gpuMutex.Unlock()
+	if dropped >= len(backends) {
+		return "default"
 	}
+	return backends[dropped]
 }
 
-func checkDx(networkPath string) {
-	if !hasEigen {
-		log.Fatalf("Dx12 backend cannot be validated")
+// selfCheck runs a short benchmark on gpu with lc0's check backend, which
+// compares the results of backend with those of a CPU reference. It returns
+// whether they differ, or an error if the check could not run.
+func selfCheck(networkPath string, backend string, gpu int) (bool, error) {
+	if !lc0Caps.Has("check") {
+		return false, errors.New("lc0 has no check backend")
 	}
-	log.Println("Sanity checking the dx12 driver.")
-	cmd := exec.Command(lc0Exe)
-	sGpu := ""
-	if *gpu >= 0 {
-		sGpu = fmt.Sprintf(",gpu=%v", *gpu)
+	opts := []string{"mode=check", "freq=1.0", "atol=5e-1", backend}
+	if *checkRef != "" {
+		opts = append(opts, *checkRef)
+	} else if !lc0Caps.Has("eigen") && !lc0Caps.Has("blas") {
+		return false, errors.New("lc0 has no CPU backend to compare with, see --self-check-reference")
+	}
+	if gpu >= 0 {
+		opts = append(opts, fmt.Sprintf("gpu=%v", gpu))
 	}
+	cmd := exec.Command(lc0Exe)
 	cmd.Args = append(cmd.Args, "benchmark", "-w", networkPath, "--backend=check")
-	cmd.Args = append(cmd.Args, fmt.Sprintf("--backend-opts=mode=check,freq=1.0,atol=5e-1,dx12%v", sGpu))
+	cmd.Args = append(cmd.Args, fmt.Sprintf("--backend-opts=%s", strings.Join(opts, ",")))
 	// Add the startpos fen to get consistent behavior with old and new lc0 benchmark.
 	cmd.Args = append(cmd.Args, "--fen=rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1")
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		log.Fatal(err)
+		return false, err
+	}
+	failed := bytes.Contains(out, []byte("*** ERROR check failed"))
+	result := "passed"
+	if failed {
+		result = "failed"
+	}
+	selfChecks.Inc(backend, result)
+	status.Update(func(s *status.Status) {
+		s.SelfCheck = backend + " " + result
+		if multiGpu {
+			s.SelfCheck += fmt.Sprintf(" on GPU %d", gpu)
+		}
+		s.SelfCheckTime = time.Now()
+	})
+	return failed, nil
+}
+
+func checkDx(networkPath string, gpu int) {
+	engineLog.Infof("Sanity checking the dx12 driver.")
+	failed, err := selfCheck(networkPath, "dx12", gpu)
+	if err != nil {
+		engineLog.Fatalf("Dx12 backend cannot be validated: %v", err)
 	}
-	if bytes.Contains(out, []byte("*** ERROR check failed")) {
-		log.Fatal("The dx12 backend failed the self check - try updating gpu drivers")
+	if failed {
+		selfCheckFailed("The dx12 backend failed the self check - try updating gpu drivers", gpu)
 	}
-	log.Println("The dx12 driver passed the initial sanity check.")
+	engineLog.Infof("The dx12 driver passed the initial sanity check.")
 }
 
-func (c *cmdWrapper) launch(networkPath string, otherNetPath string, args []string, input bool) {
-	c.Cmd = exec.Command(lc0Exe)
-	// Add the "selfplay" or "uci" part first
-	mode := args[0]
-	c.Cmd.Args = append(c.Cmd.Args, mode)
-	args = args[1:]
-	if mode != "selfplay" {
-		c.Cmd.Args = append(c.Cmd.Args, "--backend=multiplexing")
+// periodicSelfCheck self checks the backend between games, once
+// --self-check-interval has passed since the last check.
+func (w *worker) periodicSelfCheck(networkPath string) {
+	if *checkInterval <= 0 || *backopts != "" {
+		return
 	}
-	if *lc0Args != "" {
-		log.Println("WARNING: Option --lc0args is for testing, not production use!")
-		log.SetPrefix("TESTING: ")
-		parts := strings.Split(*lc0Args, " ")
-		c.Cmd.Args = append(c.Cmd.Args, parts...)
+	backend := backendFor(policyFor(networkPath, w.gpu), w.gpu)
+	if backend == "default" || capabilities.IsCPU(backend) {
+		return
 	}
-	parallelism := *parallel
-	sGpu := ""
-	if *gpu >= 0 {
-		sGpu = fmt.Sprintf(",gpu=%v", *gpu)
+	if !w.lastSelfCheck.IsZero() && time.Since(w.lastSelfCheck) < *checkInterval {
+		return
 	}
-	// Check the dx12 backend if it is the first time or we changed net, but only if no higher
-	// priority backend is available.
-	if !hasCuda && !hasCudnn && hasDx && testedDxNet != networkPath {
-		checkDx(networkPath)
-		testedDxNet = networkPath
+	w.lastSelfCheck = time.Now()
+	engineLog.Infof("Self checking the %s backend", backend)
+	failed, err := selfCheck(networkPath, backend, w.gpu)
+	if err != nil {
+		engineLog.Warnf("Unable to self check the %s backend: %v", backend, err)
+		return
 	}
-	if *backopts != "" {
-		// Check against small token blacklist.
-		tokens := regexp.MustCompile("[,=().0-9]").Split(*backopts, -1)
-		for _, token := range tokens {
-			switch token {
-			case "mlh", "random", "recordreplay", "trivial":
-				log.Fatalf("Not accepted in --backend-opts: %s", token)
-			}
-		}
-		c.Cmd.Args = append(c.Cmd.Args, fmt.Sprintf("--backend-opts=%s", *backopts))
-	} else if hasCudnn {
-		c.Cmd.Args = append(c.Cmd.Args, fmt.Sprintf("--backend-opts=backend=cudnn-auto%v", sGpu))
-		if parallelism <= 0 && parallelism32 {
-			parallelism = 32
-		}
-	} else if hasCuda {
-		c.Cmd.Args = append(c.Cmd.Args, fmt.Sprintf("--backend-opts=backend=cuda-auto%v", sGpu))
-		if parallelism <= 0 && parallelism32 {
-			parallelism = 32
-		}
-	} else if hasDx {
-		c.Cmd.Args = append(c.Cmd.Args, fmt.Sprintf("--backend-opts=check(freq=1e-5,atol=5e-1,dx12%v)", sGpu))
-	} else if hasOpenCL {
-		c.Cmd.Args = append(c.Cmd.Args, fmt.Sprintf("--backend-opts=backend=opencl%v", sGpu))
+	if !failed {
+		engineLog.Infof("The %s backend passed the self check", backend)
+		return
 	}
-	if parallelism > 0 && mode == "selfplay" {
-		c.Cmd.Args = append(c.Cmd.Args, fmt.Sprintf("--parallelism=%v", parallelism))
+	msg := fmt.Sprintf("The %s backend failed the self check - the GPU may be faulty or overclocked, try updating gpu drivers", backend)
+	if multiGpu {
+		msg = fmt.Sprintf("GPU %d: %s", w.gpu, msg)
 	}
-	c.Cmd.Args = append(c.Cmd.Args, args...)
-	if otherNetPath == "" {
-		c.Cmd.Args = append(c.Cmd.Args, fmt.Sprintf("--weights=%s", networkPath))
-	} else {
-		c.Cmd.Args = append(c.Cmd.Args, fmt.Sprintf("--player1.weights=%s", networkPath))
-		c.Cmd.Args = append(c.Cmd.Args, fmt.Sprintf("--player2.weights=%s", otherNetPath))
-		c.Cmd.Args = append(c.Cmd.Args, "--no-share-trees")
+	if *checkStop {
+		selfCheckFailed(msg, w.gpu)
 	}
+	engineLog.Errorf("%s", msg)
+	webhook.Send(webhook.SelfCheckFailed, msg, map[string]interface{}{"backend": backend, "gpu": gpuTypeOf(w.gpu)})
+}
+
+// selfCheckFailed notifies the webhooks about a failed backend self check
+// of gpu and exits.
+func selfCheckFailed(msg string, gpu int) {
+	webhook.SendAndWait(webhook.SelfCheckFailed, msg, map[string]interface{}{"backend": backendName(gpu), "gpu": gpuTypeOf(gpu)})
+	engineLog.Fatalf("%s", msg)
+}
 
-	fmt.Printf("Args: %v\n", c.Cmd.Args)
+// gamePosition is a position of a selfplay game.
+type gamePosition struct {
+	fen string
+	// The UCI position command with all the moves played to reach it, so
+	// that lc0 gives the network the same history planes as in selfplay.
+	uci string
+}
 
-	stdout, err := c.Cmd.StdoutPipe()
-	if err != nil {
-		log.Fatal(err)
+// gamePositions returns the position before each move, from the moves lc0
+// sends with gameready.
+func gamePositions(moves []string) ([]gamePosition, error) {
+	game := chess.NewGame(chess.UseNotation(chess.LongAlgebraicNotation{}))
+	start := "position startpos"
+	if len(moves) > 6 && moves[len(moves)-7] == "from_fen" {
+		fen := strings.Join(moves[len(moves)-6:], " ")
+		fen_func, err := chess.FEN(fen)
+		if err != nil {
+			return nil, err
+		}
+		moves = moves[:len(moves)-7]
+		game = chess.NewGame(chess.UseNotation(chess.LongAlgebraicNotation{}), fen_func)
+		start = "position fen " + fen
+	}
+	var positions []gamePosition
+	for i, m := range moves {
+		uci := start
+		if i > 0 {
+			uci += " moves " + strings.Join(moves[:i], " ")
+		}
+		positions = append(positions, gamePosition{fen: game.Position().String(), uci: uci})
+		if err := game.MoveStr(m); err != nil {
+			return nil, err
+		}
 	}
+	return positions, nil
+}
 
-	c.Cmd.Stderr = c.Cmd.Stdout
+// countPieces returns the number of pieces in a FEN.
+func countPieces(fen string) int {
+	n := 0
+	for _, c := range strings.Fields(fen)[0] {
+		if c >= 'A' && c != '/' {
+			n++
+		}
+	}
+	return n
+}
 
-	// If the game wasn't played with resign, and the engine supports it,
+// cpuBackend returns the backend spot checks evaluate positions with, empty
+// if lc0 has none.
+func cpuBackend() string {
+	if *checkRef != "" {
+		return *checkRef
+	}
+	for _, b := range []string{"eigen", "blas", "onnx-cpu"} {
+		if lc0Caps.Has(b) {
+			return b
+		}
+	}
+	return ""
+}
+
+// cpuEval is the network's evaluation of a position, without search.
+type cpuEval struct {
+	q float64
+	// Priors by policy index.
+	policy map[int]float64
+}
+
+var (
+	moveStatsRegex   = regexp.MustCompile(`^info string [a-h][1-8][a-h][1-8][qrbn]?\s+\(\s*(\d+)\s*\).*\(P:\s*([\d.]+)%\)`)
+	scoreRegex       = regexp.MustCompile(`score cp (-?\d+)`)
+	softmaxTempRegex = regexp.MustCompile(`^--policy-softmax-temp=(.*)$`)
+	noiseRegex       = regexp.MustCompile(`^--noise(?:-epsilon=(.*))?$`)
+)
+
+// spotPolicyTemp returns the policy softmax temperature selfplay with params
+// uses, or "" if the priors lc0 recorded cannot be reproduced: the params do
+// not give the temperature, or Dirichlet noise is added to the priors at the
+// roots.
+func spotPolicyTemp(params []string) string {
+	temp := ""
+	noiseOff := false
+	for _, p := range params {
+		if m := softmaxTempRegex.FindStringSubmatch(p); m != nil {
+			temp = ""
+			if _, err := strconv.ParseFloat(m[1], 64); err == nil {
+				temp = m[1]
+			}
+		} else if m := noiseRegex.FindStringSubmatch(p); m != nil {
+			eps, err := strconv.ParseFloat(m[1], 64)
+			noiseOff = err == nil && eps == 0
+		}
+	}
+	if !noiseOff {
+		return ""
+	}
+	return temp
+}
+
+// evaluateOnCPU has lc0 evaluate the positions with a CPU backend. With one
+// node the score is the network's value, and the move stats show the
+// priors, with softmax temperature temp if set, with their policy indices.
+func evaluateOnCPU(networkPath string, positions []gamePosition, temp string) ([]cpuEval, error) {
+	backend := cpuBackend()
+	if backend == "" {
+		return nil, errors.New("lc0 has no CPU backend, see --self-check-reference")
+	}
+	cmd := exec.Command(lc0Exe, "uci", "--weights="+networkPath, "--backend="+backend, "--threads=1",
+		"--verbose-move-stats", "--score-type=Q")
+	if temp != "" {
+		cmd.Args = append(cmd.Args, "--policy-softmax-temp="+temp)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		stdin.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	// Big networks are slow on the CPU, but not this slow.
+	timer := time.AfterFunc(10*time.Minute, func() {
+		cmd.Process.Kill()
+	})
+	defer timer.Stop()
+	scanner := bufio.NewScanner(stdout)
+	var evals []cpuEval
+	for _, p := range positions {
+		fmt.Fprintf(stdin, "%s\ngo nodes 1\n", p.uci)
+		e := cpuEval{q: math.NaN(), policy: map[int]float64{}}
+		for {
+			if !scanner.Scan() {
+				return nil, fmt.Errorf("lc0 with the %s backend exited while evaluating %s", backend, p.fen)
+			}
+			line := scanner.Text()
+			if strings.HasPrefix(line, "bestmove") {
+				break
+			}
+			if m := moveStatsRegex.FindStringSubmatch(line); m != nil {
+				idx, _ := strconv.Atoi(m[1])
+				p, _ := strconv.ParseFloat(m[2], 64)
+				e.policy[idx] = p / 100
+			} else if m := scoreRegex.FindStringSubmatch(line); m != nil {
+				cp, _ := strconv.Atoi(m[1])
+				e.q = float64(cp) / 10000
+			}
+		}
+		evals = append(evals, e)
+	}
+	fmt.Fprintln(stdin, "quit")
+	return evals, nil
+}
+
+// policyDivergence returns the Kullback-Leibler divergence of the priors
+// from the visits of a training record, as lc0 computes policy_kld. It fails
+// if a visited move has no prior.
+func policyDivergence(r *trainingdata.Record, priors map[int]float64) (float64, bool) {
+	kld := 0.0
+	for idx, v := range r.Probabilities {
+		if v <= 0 {
+			continue
+		}
+		p, ok := priors[idx]
+		if !ok {
+			return 0, false
+		}
+		// lc0 prints two decimals of percentages.
+		p = math.Max(p, 0.00005)
+		kld += float64(v) * math.Log(float64(v)/p)
+	}
+	return kld, true
+}
+
+// spotCheck replays a sample of the positions of a selfplay game on the CPU
+// once in --spot-check-games games, starting with the first, to compare the
+// network outputs with those in the training data. Policies are compared
+// with softmax temperature temp, or not at all if it is empty. The training
+// file is read right away, before the upload deletes it, and the comparison
+// runs in the background, one at a time.
+func (w *worker) spotCheck(networkPath string, gi gameInfo, temp string) {
+	if *spotGames <= 0 || *spotPositions <= 0 || capabilities.IsCPU(backendName(w.gpu)) {
+		return
+	}
+	w.spotCountdown--
+	if w.spotCountdown > 0 {
+		return
+	}
+	spotMutex.Lock()
+	if spotBusy {
+		spotMutex.Unlock()
+		return
+	}
+	spotBusy = true
+	spotMutex.Unlock()
+	w.spotCountdown = *spotGames
+	done := func() {
+		spotMutex.Lock()
+		spotBusy = false
+		spotMutex.Unlock()
+	}
+	records, err := trainingdata.Read(gi.fname)
+	if err != nil {
+		engineLog.Warnf("Unable to spot check %s: %v", gi.fname, err)
+		done()
+		return
+	}
+	positions, err := gamePositions(gi.moves)
+	if err != nil || len(positions) < len(records) {
+		engineLog.Warnf("Unable to spot check %s: the moves do not match the %d positions", gi.fname, len(records))
+		done()
+		return
+	}
+	// Positions played from the opening book have no records.
+	positions = positions[len(positions)-len(records):]
+	var candidates []int
+	for i, r := range records {
+		if !math.IsNaN(float64(r.OrigQ)) {
+			candidates = append(candidates, i)
+		}
+	}
+	n := *spotPositions
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	var sample []*trainingdata.Record
+	var samplePositions []gamePosition
+	for j := 0; j < n; j++ {
+		i := candidates[j*len(candidates)/n]
+		if records[i].Pieces() != countPieces(positions[i].fen) {
+			engineLog.Warnf("Unable to spot check %s: the positions do not match the moves", gi.fname)
+			done()
+			return
+		}
+		sample = append(sample, records[i])
+		samplePositions = append(samplePositions, positions[i])
+	}
+	go func() {
+		defer done()
+		w.compareOnCPU(networkPath, sample, samplePositions, temp)
+	}()
+}
+
+// compareOnCPU evaluates training positions on the CPU and reports if their
+// network value, or the divergence of their priors with softmax temperature
+// temp from the visits, is off by more than the tolerances. Without temp, or
+// for records with transformed policies, only values are compared.
+func (w *worker) compareOnCPU(networkPath string, records []*trainingdata.Record, positions []gamePosition, temp string) {
+	if len(records) == 0 {
+		return
+	}
+	evals, err := evaluateOnCPU(networkPath, positions, temp)
+	if err != nil {
+		engineLog.Warnf("Unable to spot check: %v", err)
+		return
+	}
+	valueDrift, policyDrift := 0.0, 0.0
+	for i, r := range records {
+		if d := math.Abs(evals[i].q - float64(r.OrigQ)); d > valueDrift || math.IsNaN(d) {
+			valueDrift = d
+		}
+		if temp == "" || r.Transform() != 0 {
+			continue
+		}
+		if kld, ok := policyDivergence(r, evals[i].policy); ok {
+			policyDrift = math.Max(policyDrift, math.Abs(kld-float64(r.PolicyKLD)))
+		}
+	}
+	failed := !(valueDrift <= *spotValueTol && policyDrift <= *spotPolicyTol)
+	result := "passed"
+	if failed {
+		result = "failed"
+	}
+	spotChecks.Add(float64(len(records)), result)
+	summary := fmt.Sprintf("%d positions, value drift %.3f, policy drift %.3f", len(records), valueDrift, policyDrift)
+	if temp == "" {
+		summary = fmt.Sprintf("%d positions, value drift %.3f, policy not compared", len(records), valueDrift)
+	}
+	status.Update(func(s *status.Status) {
+		s.SpotCheck = result + ", " + summary
+		if multiGpu {
+			s.SpotCheck += fmt.Sprintf(" on GPU %d", w.gpu)
+		}
+		s.SpotCheckTime = time.Now()
+	})
+	if !failed {
+		engineLog.Infof("Spot check passed: %s", summary)
+		return
+	}
+	msg := fmt.Sprintf("Selfplay results differ from the CPU's (%s) - the GPU may be faulty or overclocked", summary)
+	if multiGpu {
+		msg = fmt.Sprintf("GPU %d: %s", w.gpu, msg)
+	}
+	data := map[string]interface{}{"backend": backendName(w.gpu), "gpu": gpuTypeOf(w.gpu), "value_drift": valueDrift, "policy_drift": policyDrift}
+	if *checkStop {
+		webhook.SendAndWait(webhook.SpotCheckFailed, msg, data)
+		engineLog.Fatalf("%s", msg)
+	}
+	engineLog.Errorf("%s", msg)
+	webhook.Send(webhook.SpotCheckFailed, msg, data)
+}
+func (c *cmdWrapper) launch(networkPath string, otherNetPath string, args []string, input bool) {
+	c.Cmd = exec.Command(lc0Exe)
+	// Add the "selfplay" or "uci" part first
+	mode := args[0]
+	c.Cmd.Args = append(c.Cmd.Args, mode)
+	args = args[1:]
+	if mode != "selfplay" {
+		c.Cmd.Args = append(c.Cmd.Args, "--backend=multiplexing")
+	}
+	if *lc0Args != "" {
+		engineLog.Warnf("Option --lc0args is for testing, not production use!")
+		logging.SetPrefix("TESTING: ")
+		parts := strings.Split(*lc0Args, " ")
+		c.Cmd.Args = append(c.Cmd.Args, parts...)
+	}
+	rule := policyFor(networkPath, c.gpu)
+	if rule != nil {
+		engineLog.Infof("Policy rule %q applies", rule.Name)
+		c.Cmd.Args = append(c.Cmd.Args, rule.Lc0Flags...)
+	}
+	backend := backendFor(rule, c.gpu)
+	parallelism := *parallel
+	// Check the dx12 backend if it is the first time or we changed net, but only if no higher
+	// priority backend is available.
+	dxMutex.Lock()
+	if *backopts == "" && backend == "dx12" && testedDxNets[c.gpu] != networkPath {
+		checkDx(networkPath, c.gpu)
+		testedDxNets[c.gpu] = networkPath
+	}
+	dxMutex.Unlock()
+	if *backopts == "" && (backend == "cudnn-auto" || backend == "cuda-auto") {
+		gpuMutex.Lock()
+		if parallelism <= 0 && parallelism32 && !no32[c.gpu] {
+			parallelism = 32
+		}
+		gpuMutex.Unlock()
+	}
+	var extraOpts []string
+	if rule != nil && rule.BackendOpts != "" {
+		extraOpts = append(extraOpts, rule.BackendOpts)
+	}
+	if c.tuned != nil && c.tuned.BackendOpts != "" {
+		extraOpts = append(extraOpts, c.tuned.BackendOpts)
+	}
+	if opts := backendOpts(c.gpu, backend, extraOpts...); opts != "" {
+		c.Cmd.Args = append(c.Cmd.Args, fmt.Sprintf("--backend-opts=%s", opts))
+	}
+	// The parallelism was chosen for this GPU, rather than guessed.
+	fixedParallelism := *parallel > 0
+	if *parallel <= 0 && rule != nil && rule.Parallelism > 0 {
+		parallelism = rule.Parallelism
+		fixedParallelism = true
+	} else if c.tuned != nil {
+		parallelism = c.tuned.Parallelism
+		fixedParallelism = true
+	}
+	if parallelism > 0 && mode == "selfplay" {
+		c.Cmd.Args = append(c.Cmd.Args, fmt.Sprintf("--parallelism=%v", parallelism))
+	}
+	c.Cmd.Args = append(c.Cmd.Args, args...)
+	if otherNetPath == "" {
+		c.Cmd.Args = append(c.Cmd.Args, fmt.Sprintf("--weights=%s", networkPath))
+	} else {
+		c.Cmd.Args = append(c.Cmd.Args, fmt.Sprintf("--player1.weights=%s", networkPath))
+		c.Cmd.Args = append(c.Cmd.Args, fmt.Sprintf("--player2.weights=%s", otherNetPath))
+		c.Cmd.Args = append(c.Cmd.Args, "--no-share-trees")
+	}
+
+	engineLog.Infof("Args: %v", c.Cmd.Args)
+	progressMutex.Lock()
+	if lc0Launched {
+		lc0Restarts.Inc()
+	}
+	lc0Launched = true
+	progressMutex.Unlock()
+	if mode == "selfplay" {
+		parallelismGauge.Set(math.Max(float64(parallelism), 0), gpuLabel(c.gpu))
+	}
+	if *backopts != "" {
+		backend = *backopts
+	}
+	c.setBackend(backend)
+
+	stdout, err := c.Cmd.StdoutPipe()
+	if err != nil {
+		engineLog.Fatalf("%v", err)
+	}
+
+	c.Cmd.Stderr = c.Cmd.Stdout
+
+	// If the game wasn't played with resign, and the engine supports it,
 	// this will be populated by the resign_report before the gameready
 	// with the value which the resign threshold should be kept below to
 	// avoid a false positive.
 	last_fp_threshold := -1.0
+	c.openTranscript()
 	go func() {
 		defer close(c.BestMove)
 		defer close(c.gi)
+		defer close(c.readDone)
 		stdoutScanner := bufio.NewScanner(stdout)
 		for stdoutScanner.Scan() {
 			line := stdoutScanner.Text()
+			c.writeTranscript(line)
+			c.addTail(line)
+			if c.watch != nil {
+				c.watch.Output()
+			}
 			//			fmt.Printf("lc0: %s\n", line)
 			switch {
 			case strings.HasPrefix(line, "Unknown command line flag"):
-				fmt.Println(line)
-				log.Fatal("You probably have an old lc0 version")
+				c.engineLine(logging.Info, line)
+				engineLog.Fatalf("lc0 %s does not know a flag the client uses, you probably need a newer version", lc0Caps.Version)
 			case strings.Contains(line, "GPU: GeForce GTX 16"):
 				fallthrough // Does not contain "fp16" so the following works fine.
 			case strings.Contains(line, "Switching to"):
-				fmt.Println(line)
-				if parallelism == 32 && parallelism32 && !strings.Contains(line, "fp16") {
-					parallelism32 = false
+				c.engineLine(logging.Info, line)
+				if parallelism == 32 && parallelism32 && !fixedParallelism && !strings.Contains(line, "fp16") {
+					gpuMutex.Lock()
+					no32[c.gpu] = true
+					gpuMutex.Unlock()
 					if mode == "selfplay" && *parallel <= 0 {
-						log.Println("Restarting with default parallelism")
+						engineLog.Infof("Restarting with default parallelism")
+						lc0Retries.Inc()
 						c.Retry <- true
 					}
 				}
@@ -449,18 +1641,20 @@ func (c *cmdWrapper) launch(networkPath string, otherNetPath string, args []stri
 				if fp_threshold_idx >= 0 {
 					last_fp_threshold, err = strconv.ParseFloat(args[fp_threshold_idx], 64)
 					if err != nil {
-						log.Printf("Malformed resign_report: %q", line)
+						engineLog.Warnf("Malformed resign_report: %q", line)
 						last_fp_threshold = -1.0
+					} else if last_fp_threshold >= 0 {
+						fpThresholds.Observe(last_fp_threshold)
 					}
 				}
-				fmt.Println(line)
+				c.engineLine(logging.Info, line)
 			case strings.HasPrefix(line, "gameready "):
 				// filename is between "trainingfile" and "gameid"
 				idx1 := strings.Index(line, "trainingfile")
 				idx2 := strings.LastIndex(line, "gameid")
 				idx3 := strings.LastIndex(line, "moves")
 				if idx1 < 0 || idx2 < 0 || idx3 < 0 {
-					log.Printf("Malformed gameready: %q", line)
+					engineLog.Warnf("Malformed gameready: %q", line)
 					break
 				}
 				idx4 := strings.LastIndex(line, "player1")
@@ -478,41 +1672,44 @@ func (c *cmdWrapper) launch(networkPath string, otherNetPath string, args []stri
 				}
 				start_ply_count := -1
 				if idx6 >= 0 {
-					start_ply_count, err = strconv.Atoi(line[idx6+15 : idx4-1])
+					start_ply_count, _ = strconv.Atoi(line[idx6+15 : idx4-1])
 				}
 				file := line[idx1+13 : idx2-1]
-				pgn := convertMovesToPGN(strings.Split(line[idx3+6:len(line)], " "), result, start_ply_count)
-				fmt.Printf("PGN: %s\n", pgn)
-				c.gi <- gameInfo{pgn: pgn, fname: file, fp_threshold: last_fp_threshold, player1: player, result: result}
+				moves := strings.Split(line[idx3+6:len(line)], " ")
+				pgn := convertMovesToPGN(moves, result, start_ply_count)
+				engineLog.Infof("PGN: %s", pgn)
+				if c.watch != nil {
+					c.watch.Game()
+				}
+				c.gi <- gameInfo{pgn: pgn, fname: file, fp_threshold: last_fp_threshold, player1: player, result: result, moves: moves}
 				last_fp_threshold = -1.0
 			case strings.HasPrefix(line, "bestmove "):
 				//				fmt.Println(line)
 				c.BestMove <- strings.Split(line, " ")[1]
 			case strings.HasPrefix(line, "id name Lc0 "):
 				c.Version = strings.Split(line, " ")[3]
-				fmt.Println(line)
+				status.Update(func(s *status.Status) {
+					s.Lc0Version = c.Version
+				})
+				c.engineLine(logging.Info, line)
 			case strings.HasPrefix(line, "info"):
-				break
+				c.engineLine(logging.Debug, line)
 			case strings.HasPrefix(line, "GPU: "):
-				if *report_gpu && *backopts == "" {
-					gpuType = strings.TrimPrefix(line, "GPU: ")
-				}
-				fmt.Println(line)
+				setGpuType(c.gpu, strings.TrimPrefix(line, "GPU: "))
+				c.setDevice(strings.TrimPrefix(line, "GPU: "))
+				c.engineLine(logging.Info, line)
 			case strings.HasPrefix(line, "Selected device: "):
-				if *report_gpu && *backopts == "" {
-					gpuType = strings.TrimPrefix(line, "Selected device: ")
-				}
-				fmt.Println(line)
+				setGpuType(c.gpu, strings.TrimPrefix(line, "Selected device: "))
+				c.setDevice(strings.TrimPrefix(line, "Selected device: "))
+				c.engineLine(logging.Info, line)
 			case strings.HasPrefix(line, "BLAS"):
-				if *report_gpu && *backopts == "" {
-					gpuType = "None"
-				}
-				fmt.Println(line)
+				setGpuType(c.gpu, "None")
+				c.engineLine(logging.Info, line)
 			case strings.HasPrefix(line, "*** ERROR check failed"):
-				fmt.Println(line)
-				log.Fatal("The dx12 backend failed the self check - try updating gpu drivers")
+				c.engineLine(logging.Info, line)
+				selfCheckFailed("The dx12 backend failed the self check - try updating gpu drivers", c.gpu)
 			default:
-				fmt.Println(line)
+				c.engineLine(logging.Info, line)
 			}
 		}
 	}()
@@ -523,7 +1720,129 @@ func (c *cmdWrapper) launch(networkPath string, otherNetPath string, args []stri
 
 	err = c.Cmd.Start()
 	if err != nil {
-		log.Fatal(err)
+		engineLog.Fatalf("%v", err)
+	}
+	c.setRunning(true)
+}
+
+// backendOpts returns the --backend-opts value launch uses for backend on
+// gpu, with extra options added, or "" for lc0's default backend.
+func backendOpts(gpu int, backend string, extra ...string) string {
+	if *backopts != "" {
+		return *backopts
+	}
+	opts := []string{}
+	if gpu >= 0 {
+		opts = append(opts, fmt.Sprintf("gpu=%v", gpu))
+	}
+	switch backend {
+	case "default":
+		return strings.Join(extra, ",")
+	case "dx12":
+		return fmt.Sprintf("check(freq=1e-5,atol=5e-1,%s)", strings.Join(append([]string{"dx12"}, opts...), ","))
+	}
+	opts = append([]string{"backend=" + backend}, opts...)
+	return strings.Join(append(opts, extra...), ",")
+}
+
+// gpuDevice returns the device lc0 reports for gpu, probing it with the
+// selected backend the first time, or "" if unknown.
+func gpuDevice(networkPath string, gpu int) string {
+	deviceMutex.Lock()
+	defer deviceMutex.Unlock()
+	if device, ok := gpuDevices[gpu]; ok {
+		return device
+	}
+	device := ""
+	if b := selectedBackend(gpu); b != "default" {
+		probe := gpu
+		if probe < 0 {
+			probe = 0
+		}
+		var err error
+		device, err = probeGpu(networkPath, b, probe)
+		if err != nil {
+			engineLog.Warnf("Unable to probe GPU %d: %v", probe, err)
+			device = ""
+		}
+	}
+	gpuDevices[gpu] = device
+	return device
+}
+
+// policyFor returns the policy rule for running lc0 on gpu with the network
+// at networkPath, or nil if none applies.
+func policyFor(networkPath string, gpu int) *policy.Rule {
+	if policyFile == nil {
+		return nil
+	}
+	facts := policy.Facts{
+		Gpu:        gpuDevice(networkPath, gpu),
+		Lc0Version: lc0Caps.Version,
+		OS:         runtime.GOOS,
+	}
+	if info, err := netinfo.ReadFile(networkPath); err == nil {
+		facts.Architecture = info.Architecture()
+	}
+	return policyFile.Evaluate(facts)
+}
+
+// backendFor returns the backend to use on gpu with rule, which may be nil.
+func backendFor(rule *policy.Rule, gpu int) string {
+	if rule == nil || rule.Backend == "" {
+		return selectedBackend(gpu)
+	}
+	if rule.Backend != "default" && !lc0Caps.Has(rule.Backend) {
+		engineLog.Warnf("Policy rule %q asks for the %s backend, which lc0 does not support", rule.Name, rule.Backend)
+		return selectedBackend(gpu)
+	}
+	return rule.Backend
+}
+
+// backendName describes the backend selected by launch on gpu.
+func backendName(gpu int) string {
+	if *backopts != "" {
+		return *backopts
+	}
+	return selectedBackend(gpu)
+}
+
+// fallbackBackend switches gpu to the next backend in order of preference,
+// and returns false if there is none. Other GPUs keep their backend.
+func fallbackBackend(gpu int) bool {
+	if *backopts != "" {
+		return false
+	}
+	gpuMutex.Lock()
+	if droppedBackends[gpu] >= len(backends) {
+		gpuMutex.Unlock()
+		return false
+	}
+	from := backends[droppedBackends[gpu]]
+	droppedBackends[gpu]++
+	gpuMutex.Unlock()
+	engineLog.Warnf("Falling back from the %s backend to %s", from, backendName(gpu))
+	return true
+}
+
+// reportCrashLoop summarizes the last lc0 failures on gpu, and falls back to
+// another backend if enabled.
+func reportCrashLoop(failures []*lc0Failure, gpu int) {
+	var causes []crashloop.Cause
+	for _, f := range failures {
+		causes = append(causes, f.cause)
+	}
+	last := failures[len(failures)-1]
+	msg := fmt.Sprintf("lc0 failed %d times in a row with the %s backend: %s", len(failures), backendName(gpu), crashloop.Summarize(causes))
+	engineLog.Errorf("%s", msg)
+	engineLog.Errorf("Last lc0 output:")
+	for _, line := range last.tail {
+		engineLog.Errorf("  %s", line)
+	}
+	engineLog.Errorf("Hint: %s", crashloop.Hints[last.cause])
+	webhook.Send(webhook.CrashLoop, msg, map[string]interface{}{"backend": backendName(gpu), "last_output": last.tail})
+	if *fallback && last.cause != crashloop.UnknownFlag {
+		fallbackBackend(gpu)
 	}
 }
 
@@ -537,7 +1856,7 @@ func resultToNum(result string) int {
 	return 0
 }
 
-func playMatch(httpClient *http.Client, ngr client.NextGameResponse, baselinePath string, candidatePath string, params []string) (*client.NextGameResponse, error) {
+func (w *worker) playMatch(httpClient *http.Client, ngr client.NextGameResponse, baselinePath string, candidatePath string, params []string) (*client.NextGameResponse, error) {
 	// lc0 needs selfplay first in the argument list.
 	params = append([]string{"selfplay"}, params...)
 	// Training flag used for simplicity for now.
@@ -552,6 +1871,8 @@ func playMatch(httpClient *http.Client, ngr client.NextGameResponse, baselinePat
 		params = append(params, "--visits=800")
 	}
 	c := createCmdWrapper()
+	c.gpu = w.gpu
+	c.startWatch(ngr.Type)
 	c.launch(candidatePath, baselinePath, params /* input= */, false)
 	trainDirHolder := make([]string, 1)
 	trainDirHolder[0] = ""
@@ -559,10 +1880,10 @@ func playMatch(httpClient *http.Client, ngr client.NextGameResponse, baselinePat
 		// Remove the training dir when we're done training.
 		trainDir := trainDirHolder[0]
 		if trainDir != "" {
-			log.Printf("Removing traindir: %s", trainDir)
+			schedulerLog.Infof("Removing traindir: %s", trainDir)
 			err := os.RemoveAll(trainDir)
 			if err != nil {
-				log.Printf("Error removing train dir: %v", err)
+				schedulerLog.Warnf("Error removing train dir: %v", err)
 			}
 		}
 	}()
@@ -579,12 +1900,19 @@ func playMatch(httpClient *http.Client, ngr client.NextGameResponse, baselinePat
 		curng := &ngr
 		var flipped []gameInfo
 		var normal []gameInfo
+		// Results not uploaded by now are dropped.
+		defer status.Update(func(s *status.Status) {
+			s.PendingUploads -= len(flipped) + len(normal)
+		})
 		for done := false; !done; {
 			select {
 			case <-reverseDoneCh:
-				log.Println("Match uploader exiting")
+				schedulerLog.Infof("Match uploader exiting")
 				return
 			case gi, _ := <-gameInfoCh:
+				status.Update(func(s *status.Status) {
+					s.PendingUploads++
+				})
 				if gi.player1 == "black" {
 					flipped = append(flipped, gi)
 				} else {
@@ -596,38 +1924,55 @@ func playMatch(httpClient *http.Client, ngr client.NextGameResponse, baselinePat
 							l := len(flipped)
 							nextgi := flipped[l-1]
 							flipped = flipped[:l-1]
-							log.Println("uploading match result")
-							extraParams := getExtraParams()
+							uploaderLog.Infof("uploading match result")
+							extraParams := extraParamsFor(w.gpu)
 							extraParams["engineVersion"] = c.Version
-							client.UploadMatchResult(httpClient, *hostname, curng.MatchGameId, -resultToNum(nextgi.result), nextgi.pgn, extraParams)
-							log.Println("uploaded")
+							result := -resultToNum(nextgi.result)
+							err := client.UploadMatchResult(httpClient, *hostname, curng.MatchGameId, result, nextgi.pgn, extraParams)
+							reportUpload(*curng, nextgi.result, err)
+							if err == nil {
+								recordStats(*curng, c.Version, result)
+							}
+							status.Update(func(s *status.Status) {
+								s.PendingUploads--
+							})
+							uploaderLog.Infof("uploaded")
 							curng = nil
 						} else if !curng.Flip && len(normal) > 0 {
 							l := len(normal)
 							nextgi := normal[l-1]
 							normal = normal[:l-1]
-							log.Println("uploading match result")
-							extraParams := getExtraParams()
+							uploaderLog.Infof("uploading match result")
+							extraParams := extraParamsFor(w.gpu)
 							extraParams["engineVersion"] = c.Version
-							client.UploadMatchResult(httpClient, *hostname, curng.MatchGameId, resultToNum(nextgi.result), nextgi.pgn, extraParams)
-							log.Println("uploaded")
+							result := resultToNum(nextgi.result)
+							err := client.UploadMatchResult(httpClient, *hostname, curng.MatchGameId, result, nextgi.pgn, extraParams)
+							reportUpload(*curng, nextgi.result, err)
+							if err == nil {
+								recordStats(*curng, c.Version, result)
+							}
+							status.Update(func(s *status.Status) {
+								s.PendingUploads--
+							})
+							uploaderLog.Infof("uploaded")
 							curng = nil
 						}
 					}
 					if curng != nil {
 						break
 					}
-					ng, err := client.NextGame(httpClient, *hostname, getExtraParams())
+					ng, err := client.NextGame(httpClient, *hostname, extraParamsFor(w.gpu))
 					if err != nil {
-						fmt.Printf("Error talking to server: %v\n", err)
+						schedulerLog.Warnf("Error talking to server: %v", err)
 						errCount++
 						if errCount < 10 {
 							break
 						}
 						return
 					}
+					markServerContact()
 					if ng.Type != ngr.Type || ng.Sha != ngr.Sha || ng.CandidateSha != ngr.CandidateSha {
-						log.Println("Current match finished.")
+						schedulerLog.Infof("Current match finished.")
 						pendingNextGame = &ng
 						return
 					}
@@ -638,29 +1983,42 @@ func playMatch(httpClient *http.Client, ngr client.NextGameResponse, baselinePat
 		}
 	}()
 	progressOrKill := false
+	stalled := false
+	stallTicker := time.NewTicker(time.Minute)
+	defer stallTicker.Stop()
 	for done := false; !done; {
 		select {
+		case <-stallTicker.C:
+			if checkStall(c, ngr) {
+				stalled = true
+				done = true
+			}
 		case <-c.Retry:
 			close(reverseDoneCh)
+			c.kill()
+			c.wait()
 			return nil, errors.New("retry")
 		case <-doneCh:
 			done = true
 			progressOrKill = true
-			log.Println("Received message to end matches, killing lc0")
-			c.Cmd.Process.Kill()
+			schedulerLog.Infof("Received message to end matches, killing lc0")
+			c.kill()
 		case _, ok := <-c.BestMove:
 			// Just swallow the best moves, not actually needed.
 			if !ok {
-				log.Printf("BestMove channel closed unexpectedly, exiting match loop")
+				schedulerLog.Warnf("BestMove channel closed unexpectedly, exiting match loop")
 				break
 			}
 		case gi, ok := <-c.gi:
 			if !ok {
-				log.Printf("GameInfo channel closed, exiting match loop")
+				schedulerLog.Infof("GameInfo channel closed, exiting match loop")
 				done = true
 				break
 			}
 			progressOrKill = true
+			w.addGame()
+			gamesCompleted.Inc(gameLabels(ngr)...)
+			status.AddGame(ngr.Type, gi.result, gi.pgn)
 			trainDirHolder[0] = path.Dir(gi.fname)
 			wg.Add(1)
 			go func() {
@@ -673,28 +2031,37 @@ func playMatch(httpClient *http.Client, ngr client.NextGameResponse, baselinePat
 		}
 	}
 
-	log.Println("Waiting for lc0 to stop")
-	err := c.Cmd.Wait()
+	engineLog.Infof("Waiting for lc0 to stop")
+	err := c.wait()
 	if err != nil {
-		fmt.Printf("lc0 exited with: %v", err)
+		engineLog.Warnf("lc0 exited with: %v", err)
 	}
-	log.Println("lc0 stopped")
+	checkCrash(c, ngr, err)
+	engineLog.Infof("lc0 stopped")
 	close(reverseDoneCh)
 
-	log.Println("Waiting for uploads to complete")
+	uploaderLog.Infof("Waiting for uploads to complete")
 	wg.Wait()
+	if stalled {
+		return nil, c.stallFailure("matches")
+	}
 	if !progressOrKill {
-		return nil, errors.New("Client self-exited without producing any matches.")
+		return nil, c.failure(err, "matches")
 	}
 	return pendingNextGame, nil
 }
 
-func train(httpClient *http.Client, ngr client.NextGameResponse,
+func (w *worker) train(httpClient *http.Client, ngr client.NextGameResponse,
 	networkPath string, otherNetPath string, count int, params []string, doneCh chan bool) error {
+	tuned := w.tune(networkPath, params)
+	spotTemp := spotPolicyTemp(params)
 	// lc0 needs selfplay first in the argument list.
 	params = append([]string{"selfplay"}, params...)
 	params = append(params, "--training=true")
 	c := createCmdWrapper()
+	c.gpu = w.gpu
+	c.tuned = tuned
+	c.startWatch(ngr.Type)
 	c.launch(networkPath, otherNetPath, params /* input= */, false)
 	trainDirHolder := make([]string, 1)
 	trainDirHolder[0] = ""
@@ -702,61 +2069,89 @@ func train(httpClient *http.Client, ngr client.NextGameResponse,
 		// Remove the training dir when we're done training.
 		trainDir := trainDirHolder[0]
 		if trainDir != "" {
-			log.Printf("Removing traindir: %s", trainDir)
+			schedulerLog.Infof("Removing traindir: %s", trainDir)
 			err := os.RemoveAll(trainDir)
 			if err != nil {
-				log.Printf("Error removing train dir: %v", err)
+				schedulerLog.Warnf("Error removing train dir: %v", err)
 			}
 		}
 	}()
 	wg := &sync.WaitGroup{}
 	numGames := 1
 	progressOrKill := false
+	stalled := false
+	stallTicker := time.NewTicker(time.Minute)
+	defer stallTicker.Stop()
 	for done := false; !done; {
 		select {
+		case <-stallTicker.C:
+			if checkStall(c, ngr) {
+				stalled = true
+				done = true
+			}
 		case <-c.Retry:
+			c.kill()
+			c.wait()
 			return errors.New("retry")
 		case <-doneCh:
 			done = true
 			progressOrKill = true
-			log.Println("Received message to end training, killing lc0")
-			c.Cmd.Process.Kill()
+			schedulerLog.Infof("Received message to end training, killing lc0")
+			c.kill()
 		case _, ok := <-c.BestMove:
 			// Just swallow the best moves, only needed for match play.
 			if !ok {
-				log.Printf("BestMove channel closed unexpectedly, exiting train loop")
+				schedulerLog.Warnf("BestMove channel closed unexpectedly, exiting train loop")
 				break
 			}
 		case gi, ok := <-c.gi:
 			if !ok {
-				log.Printf("GameInfo channel closed, exiting train loop")
+				schedulerLog.Infof("GameInfo channel closed, exiting train loop")
 				done = true
 				break
 			}
-			fmt.Printf("Uploading game: %d\n", numGames)
+			uploaderLog.Infof("Uploading game: %d", numGames)
 			numGames++
 			progressOrKill = true
 			trainDirHolder[0] = path.Dir(gi.fname)
-			log.Printf("trainDir=%s", trainDirHolder[0])
+			schedulerLog.Debugf("trainDir=%s", trainDirHolder[0])
 			wg.Add(1)
+			w.addGame()
+			gamesCompleted.Inc(gameLabels(ngr)...)
+			status.AddGame(ngr.Type, gi.result, gi.pgn)
+			status.Update(func(s *status.Status) {
+				s.PendingUploads++
+			})
+			w.spotCheck(networkPath, gi, spotTemp)
 			go func() {
-				uploadGame(httpClient, gi.fname, gi.pgn, ngr, c.Version, gi.fp_threshold)
+				err := uploadGame(httpClient, gi.fname, gi.pgn, ngr, c.Version, gi.fp_threshold, w.gpu)
+				reportUpload(ngr, gi.result, err)
+				if err != nil {
+					status.SetError(err)
+				}
+				status.Update(func(s *status.Status) {
+					s.PendingUploads--
+				})
 				wg.Done()
 			}()
 		}
 	}
 
-	log.Println("Waiting for lc0 to stop")
-	err := c.Cmd.Wait()
+	engineLog.Infof("Waiting for lc0 to stop")
+	err := c.wait()
 	if err != nil {
-		fmt.Printf("lc0 exited with: %v", err)
+		engineLog.Warnf("lc0 exited with: %v", err)
 	}
-	log.Println("lc0 stopped")
+	checkCrash(c, ngr, err)
+	engineLog.Infof("lc0 stopped")
 
-	log.Println("Waiting for uploads to complete")
+	uploaderLog.Infof("Waiting for uploads to complete")
 	wg.Wait()
+	if stalled {
+		return c.stallFailure("games")
+	}
 	if !progressOrKill {
-		return errors.New("Client self-exited without producing any games.")
+		return c.failure(err, "games")
 	}
 	return nil
 }
@@ -780,7 +2175,7 @@ func checkValidNetwork(dir string, sha string) (string, error) {
 		}
 		file.Close()
 		if err != nil {
-			fmt.Printf("Deleting invalid network...\n")
+			cacheLog.Warnf("Deleting invalid network...")
 			os.Remove(path)
 			return path, err
 		} else {
@@ -803,7 +2198,7 @@ func removeAllExcept(dir string, sha string, keepTime string) error {
 		if time.Since(file.ModTime()) < timeLimit {
 			continue
 		}
-		fmt.Printf("Removing %v\n", file.Name())
+		cacheLog.Infof("Removing %v", file.Name())
 		err := os.RemoveAll(filepath.Join(dir, file.Name()))
 		if err != nil {
 			return err
@@ -851,172 +2246,912 @@ func makeCacheDir(dir string) string {
 	return dir
 }
 
-func getNetwork(httpClient *http.Client, sha string, keepTime string) (string, error) {
-	dir := makeCacheDir("client-cache")
-	if keepTime != inf {
-		err := removeAllExcept(dir, sha, keepTime)
+// checkResources returns an error describing the problem if there is not
+// enough disk space or memory to work.
+func checkResources() error {
+	// lc0 writes training data to the working directory.
+	for _, dir := range []string{makeCacheDir("client-cache"), "."} {
+		free, err := sysinfo.FreeDisk(dir)
 		if err != nil {
-			log.Printf("Failed to remove old network(s): %v", err)
+			continue
+		}
+		if free < uint64(*minFreeDisk)<<20 {
+			abs, _ := filepath.Abs(dir)
+			return fmt.Errorf("Only %d MB of disk space free for %s, %d MB needed (see --min-free-disk)",
+				free>>20, abs, *minFreeDisk)
 		}
 	}
-	path, err := checkValidNetwork(dir, sha)
-	if err == nil {
-		// There is already a valid network. Use it.
-		return path, nil
+	if *minFreeMemory > 0 {
+		avail, err := sysinfo.AvailableMemory()
+		if err == nil && avail < uint64(*minFreeMemory)<<20 {
+			return fmt.Errorf("Only %d MB of memory available, %d MB needed (see --min-free-memory)",
+				avail>>20, *minFreeMemory)
+		}
 	}
+	return nil
+}
 
-	// Otherwise, let's download it
-	lock, lockHeld, err := acquireLock(dir, sha)
+// gameFiles returns the names in the cache of the networks, artifacts and
+// book ngr needs.
+func gameFiles(ngr client.NextGameResponse) []string {
+	files := []string{ngr.Sha, ngr.CandidateSha}
+	for _, artifact := range ngr.Artifacts {
+		files = append(files, artifact.Sha)
+	}
+	if u, err := url.Parse(ngr.BookUrl); err == nil && ngr.BookUrl != "" {
+		name := path.Base(u.Path)
+		files = append(files, name, book.ExtractedPath(name))
+	}
+	return files
+}
 
-	if err != nil || !lockHeld {
-		if !lockHeld {
-			log.Println("Download initiated by other client - waiting")
-			for i := 0; i < 60; i++ {
-				time.Sleep(time.Second)
-				path, err := checkValidNetwork(dir, sha)
-				if err == nil {
-					return path, nil
+// evictCache removes cached files other than those in use or in spare to free
+// disk space, sparing networks with --keep. Recently modified files are left
+// alone as other clients sharing the cache may be using them.
+func evictCache(spare ...string) {
+	cacheMutex.Lock()
+	for _, files := range inUseFiles {
+		spare = append(spare, files...)
+	}
+	cacheMutex.Unlock()
+	dirs := []string{"artifacts", "books"}
+	if !*keep {
+		dirs = append(dirs, "client-cache")
+	}
+	for _, name := range dirs {
+		dir := makeCacheDir(name)
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			kept := strings.HasSuffix(file.Name(), ".lck") || time.Since(file.ModTime()) < 10*time.Minute
+			for _, s := range spare {
+				if file.Name() == s {
+					kept = true
 				}
 			}
-			return "", errors.New("Timed out")
-		} else {
-			log.Fatalf("Unable to lock: %v", err)
+			if kept {
+				continue
+			}
+			cacheLog.Infof("Removing %v", file.Name())
+			os.RemoveAll(filepath.Join(dir, file.Name()))
 		}
 	}
+}
 
-	// Lockfile acquired, download it
-	defer lock.Unlock()
-	fmt.Println("Downloading network...")
-	for i := 0; i < 3; i++ {
-		if i > 0 {
-			log.Println("Waiting 10 seconds before retrying")
-			time.Sleep(10 * time.Second)
-		}
-		err = client.DownloadNetwork(httpClient, *networkMirror, path, sha)
+// preflight makes sure there are enough resources to work. If not, it evicts
+// the cache and pauses until enough are available.
+func preflight(spare ...string) {
+	err := checkResources()
+	if err == nil {
+		return
+	}
+	cacheLog.Warnf("%v, evicting cached files", err)
+	evictCache(spare...)
+	for {
+		err = checkResources()
 		if err == nil {
-			return checkValidNetwork(dir, sha)
+			cacheLog.Infof("Enough resources available, resuming work")
+			return
 		}
-		log.Printf("Network download failed: %v", err)
+		cacheLog.Errorf("%v. Pausing work until resources are freed, checking again in 60 seconds", err)
+		time.Sleep(60 * time.Second)
 	}
-	return "", err
 }
 
-func checkValidBook(path string, sha string) (string, error) {
-	// File already exists?
-	_, err := os.Stat(path)
+// downloadFile downloads uri to path, recording metrics for the download.
+func downloadFile(httpClient *http.Client, uri string, path string, kind string) error {
+	start := time.Now()
+	err := client.DownloadFile(httpClient, uri, path)
+	downloadDuration.Observe(time.Since(start).Seconds(), kind)
 	if err == nil {
-		file, _ := os.Open(path)
-		sum := sha256.New()
-		_, err := io.Copy(sum, file)
-		got := fmt.Sprintf("%x", sum.Sum(nil))
-		if sha != got {
-			text := fmt.Sprintf("book sha mismatch want:\n%s\ngot\n%s\n", sha, got)
-			err = errors.New(text)
-		}
-		file.Close()
-		if err != nil {
-			fmt.Printf("Deleting invalid book...\n")
-			os.Remove(path)
-			return path, err
-		} else {
-			return path, nil
+		if fi, err := os.Stat(path); err == nil {
+			downloadBytes.Add(float64(fi.Size()), kind)
 		}
 	}
-	return path, err
+	return err
 }
 
-func getBook(httpClient *http.Client, book_url string, sha string) (string, error) {
-	dir := makeCacheDir("books")
-	u, err := url.Parse(book_url)
-	if err != nil {
-		log.Println("Unable to parse book URL")
-		return "", err
-	}
-	s := strings.Split(u.Path, "/")
-	book_name := s[len(s)-1]
-	path := filepath.Join(dir, book_name)
-	_, err = checkValidBook(path, sha)
+// fetchFile makes sure there is a valid copy of a file in dir, as decided
+// by check, downloading it if needed. Only one client downloads a file at a
+// time, the others wait for it to finish.
+func fetchFile(dir string, name string, what string, check func() error, download func() error) error {
+	err := check()
 	if err == nil {
-		// Book is there, use it.
-		return path, nil
+		// There is already a valid file. Use it.
+		return nil
 	}
 
-	// Otherwise, let's download it
-	lock, lockHeld, err := acquireLock(dir, book_name)
+	// Otherwise, let's download it. Make room first, as waiting for it while
+	// holding the lock would hold up other clients.
+	defer stepAway()()
+	preflight(name)
+	lock, lockHeld, err := acquireLock(dir, name)
 
 	if err != nil || !lockHeld {
 		if !lockHeld {
-			log.Println("Book download initiated by other client")
-			return "", err
+			cacheLog.Infof("Download of %s initiated by other client - waiting", what)
+			for i := 0; i < 60; i++ {
+				time.Sleep(time.Second)
+				if check() == nil {
+					return nil
+				}
+			}
+			return errors.New("Timed out")
 		} else {
-			log.Fatalf("Unable to lock: %v", err)
+			cacheLog.Fatalf("Unable to lock: %v", err)
 		}
 	}
 
 	// Lockfile acquired, download it
 	defer lock.Unlock()
-	fmt.Println("Downloading book...")
-
-	r, err := httpClient.Get(book_url)
-	if err != nil {
-		log.Println("Book download failed")
-		return "", err
-	}
-
-	out, err := ioutil.TempFile(dir, book_name+"_tmp")
-	if err != nil {
-		log.Println("Unable to create temporary file")
-		return "", err
+	cacheLog.Infof("Downloading %s...", what)
+	for i := 0; i < 3; i++ {
+		if i > 0 {
+			cacheLog.Infof("Waiting 10 seconds before retrying")
+			time.Sleep(10 * time.Second)
+		}
+		err = download()
+		if err == nil {
+			err = check()
+			if err == nil {
+				return nil
+			}
+		}
+		cacheLog.Warnf("Download of %s failed: %v", what, err)
 	}
+	return err
+}
 
-	_, err = io.Copy(out, r.Body)
-	r.Body.Close()
-	out.Close()
-	if err == nil {
-		err = os.Rename(out.Name(), path)
+func getNetwork(httpClient *http.Client, sha string, keepTime string) (string, error) {
+	dir := makeCacheDir("client-cache")
+	if keepTime != inf {
+		err := removeAllExcept(dir, sha, keepTime)
+		if err != nil {
+			cacheLog.Warnf("Failed to remove old network(s): %v", err)
+		}
+	}
+	path := filepath.Join(dir, sha)
+	err := fetchFile(dir, sha, "network",
+		func() error {
+			_, err := checkValidNetwork(dir, sha)
+			return err
+		},
+		func() error {
+			return downloadFile(httpClient, *networkMirror+sha, path, "network")
+		})
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// logNetworkInfo logs the architecture of the network at networkPath if it
+// is not the network this worker used last.
+func (w *worker) logNetworkInfo(networkPath string) {
+	if networkPath == w.netPath {
+		return
+	}
+	w.netPath = networkPath
+	info, err := netinfo.ReadFile(networkPath)
+	if err != nil {
+		cacheLog.Warnf("Unable to read network info: %v", err)
+		return
+	}
+	status.Update(func(s *status.Status) {
+		s.Network = info.String()
+	})
+	cacheLog.Infof("Switched to network %s: %v", filepath.Base(networkPath), info)
+	checkLc0Version(lc0version.Requirement{Minimum: info.MinVersion, Source: "network " + filepath.Base(networkPath)})
+}
+
+func printNetworkInfo(networkPath string) error {
+	info, err := netinfo.ReadFile(networkPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", networkPath)
+	fmt.Printf("  Magic:            %#x\n", info.Magic)
+	if info.License != "" {
+		fmt.Printf("  License:          %s\n", info.License)
+	}
+	fmt.Printf("  Min lc0 version:  %s\n", info.MinVersion)
+	fmt.Printf("  Weights encoding: %s\n", info.WeightsEncoding)
+	fmt.Printf("  Network:          %s\n", info.Network)
+	fmt.Printf("  Input:            %s\n", info.Input)
+	fmt.Printf("  Output:           %s\n", info.Output)
+	fmt.Printf("  Policy head:      %s\n", info.Policy)
+	fmt.Printf("  Value head:       %s\n", info.Value)
+	fmt.Printf("  Moves left head:  %s\n", info.MovesLeft)
+	if info.EncoderLayers > 0 {
+		fmt.Printf("  Encoder layers:   %d\n", info.EncoderLayers)
+	} else {
+		fmt.Printf("  Blocks:           %d\n", info.Blocks)
+		fmt.Printf("  Filters:          %d\n", info.Filters)
+	}
+	if info.HasOnnx {
+		fmt.Printf("  Contains an ONNX model\n")
+	}
+	if tp := info.Training; tp != nil {
+		fmt.Printf("  Training steps:   %d\n", tp.TrainingSteps)
+		fmt.Printf("  Learning rate:    %g\n", tp.LearningRate)
+		fmt.Printf("  MSE loss:         %g\n", tp.MseLoss)
+		fmt.Printf("  Policy loss:      %g\n", tp.PolicyLoss)
+		fmt.Printf("  Accuracy:         %g\n", tp.Accuracy)
+		if tp.Lc0Params != "" {
+			fmt.Printf("  Lc0 params:       %s\n", tp.Lc0Params)
+		}
+	}
+	return nil
+}
+
+// runNetInfo implements the netinfo subcommand. Arguments are either paths to
+// network files or shas of networks in the cache, with no arguments all cached
+// networks are shown.
+func runNetInfo(args []string) int {
+	dir := makeCacheDir("client-cache")
+	if len(args) == 0 {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			clientLog.Errorf("%v", err)
+			return 1
+		}
+		for _, file := range files {
+			if file.IsDir() || strings.HasSuffix(file.Name(), ".lck") || strings.Contains(file.Name(), "_tmp") {
+				continue
+			}
+			args = append(args, file.Name())
+		}
+		if len(args) == 0 {
+			fmt.Printf("No networks in %s\n", dir)
+		}
+	}
+	status := 0
+	for _, arg := range args {
+		networkPath := arg
+		if _, err := os.Stat(networkPath); err != nil {
+			networkPath = filepath.Join(dir, arg)
+		}
+		err := printNetworkInfo(networkPath)
+		if err != nil {
+			fmt.Printf("%s: %v\n", arg, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+func checkValidFile(path string, sha string, what string) (string, error) {
+	// File already exists?
+	_, err := os.Stat(path)
+	if err == nil {
+		file, _ := os.Open(path)
+		sum := sha256.New()
+		_, err := io.Copy(sum, file)
+		got := fmt.Sprintf("%x", sum.Sum(nil))
+		if sha != got {
+			text := fmt.Sprintf("%s sha mismatch want:\n%s\ngot\n%s\n", what, sha, got)
+			err = errors.New(text)
+		}
+		file.Close()
+		if err != nil {
+			cacheLog.Warnf("Deleting invalid %s...", what)
+			os.Remove(path)
+			return path, err
+		} else {
+			return path, nil
+		}
+	}
+	return path, err
+}
+
+func getBook(httpClient *http.Client, book_url string, sha string) (string, error) {
+	dir := makeCacheDir("books")
+	u, err := url.Parse(book_url)
+	if err != nil {
+		cacheLog.Errorf("Unable to parse book URL")
+		return "", err
+	}
+	s := strings.Split(u.Path, "/")
+	book_name := s[len(s)-1]
+	path := filepath.Join(dir, book_name)
+	err = fetchFile(dir, book_name, "book",
+		func() error {
+			_, err := checkValidFile(path, sha, "book")
+			return err
+		},
+		func() error {
+			return downloadFile(httpClient, book_url, path, "book")
+		})
+	if err != nil {
+		return "", err
+	}
+	return prepareBook(path, sha)
+}
+
+// prepareBook extracts a compressed book and checks that it is a valid PGN
+// or EPD book, returning the path to give to lc0.
+func prepareBook(path string, sha string) (string, error) {
+	openingsPath := path
+	if book.IsCompressed(path) {
+		openingsPath = book.ExtractedPath(path)
+		if fi, err := os.Stat(openingsPath); err != nil || fi.ModTime().Before(bookModTime(path)) {
+			cacheLog.Infof("Extracting book %s", filepath.Base(path))
+			openingsPath, err = book.Extract(path)
+			if err != nil {
+				os.Remove(path)
+				return "", err
+			}
+		}
+	}
+	validBooksMutex.Lock()
+	valid := validBooks[openingsPath] == sha
+	validBooksMutex.Unlock()
+	if valid {
+		return openingsPath, nil
+	}
+	count, err := book.CountOpenings(openingsPath)
+	if err != nil {
+		cacheLog.Warnf("Deleting invalid book...")
+		os.Remove(path)
+		os.Remove(openingsPath)
+		return "", fmt.Errorf("Invalid book %s: %v", filepath.Base(path), err)
+	}
+	cacheLog.Infof("Book %s has %d openings", filepath.Base(openingsPath), count)
+	validBooksMutex.Lock()
+	validBooks[openingsPath] = sha
+	validBooksMutex.Unlock()
+	return openingsPath, nil
+}
+
+func bookModTime(path string) time.Time {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+func getArtifact(httpClient *http.Client, artifact client.Artifact) (string, error) {
+	name := artifact.Name
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\:`) {
+		return "", fmt.Errorf("Invalid artifact name %q", name)
+	}
+	if !shaRegex.MatchString(artifact.Sha) {
+		return "", fmt.Errorf("Invalid sha for artifact %s", name)
+	}
+	// Different versions of an artifact are kept apart by their sha.
+	dir := makeCacheDir("artifacts")
+	path := filepath.Join(dir, artifact.Sha, name)
+	os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	what := "artifact " + name
+	err := fetchFile(dir, artifact.Sha, what,
+		func() error {
+			_, err := checkValidFile(path, artifact.Sha, what)
+			return err
+		},
+		func() error {
+			return downloadFile(httpClient, artifact.Url, path, "artifact")
+		})
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// fetchArtifacts downloads the artifacts and substitutes their paths for
+// their placeholders in params.
+func fetchArtifacts(httpClient *http.Client, artifacts []client.Artifact, params []string) ([]string, error) {
+	for _, artifact := range artifacts {
+		path, err := getArtifact(httpClient, artifact)
+		if err != nil {
+			return nil, err
+		}
+		placeholder := artifact.Placeholder
+		if placeholder == "" {
+			placeholder = "{artifact:" + artifact.Name + "}"
+		}
+		for i := range params {
+			params[i] = strings.Replace(params[i], placeholder, path, -1)
+		}
+	}
+	for _, param := range params {
+		if strings.Contains(param, "{artifact:") {
+			return nil, fmt.Errorf("No artifact for parameter %s", param)
+		}
+	}
+	return params, nil
+}
+
+// provisionTablebases downloads and verifies the tablebases in --syzygy-dir,
+// after which games requesting tablebases are given them.
+func provisionTablebases(httpClient *http.Client) {
+	var mirrors []string
+	for _, m := range strings.Split(*syzygyMirrors, ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			mirrors = append(mirrors, m)
+		}
+	}
+	manifest := *syzygyList
+	if manifest == "" {
+		if len(mirrors) == 0 {
+			cacheLog.Warnf("Not providing tablebases, --syzygy-mirrors or --syzygy-manifest is needed")
+			return
+		}
+		manifest = strings.TrimSuffix(mirrors[0], "/") + "/SHA256SUMS"
+	}
+	os.MkdirAll(*syzygyDir, os.ModePerm)
+	// Clients sharing the directory take turns.
+	for {
+		lock, lockHeld, err := acquireLock(*syzygyDir, "syzygy")
+		if err != nil {
+			cacheLog.Warnf("Not providing tablebases, unable to lock: %v", err)
+			return
+		}
+		if lockHeld {
+			defer lock.Unlock()
+			break
+		}
+		time.Sleep(10 * time.Second)
+	}
+	for i := 0; ; i++ {
+		if i > 0 {
+			cacheLog.Infof("Waiting 60 seconds before retrying")
+			time.Sleep(60 * time.Second)
+		}
+		files, err := tablebase.ReadManifest(httpClient, manifest, *syzygyPieces)
+		if err == nil {
+			err = tablebase.Sync(httpClient, *syzygyDir, files, mirrors)
+		}
+		if err != nil {
+			cacheLog.Warnf("Tablebase provisioning failed: %v", err)
+			continue
+		}
+		cacheLog.Infof("%d tablebase files up to %d pieces ready in %s", len(files), *syzygyPieces, *syzygyDir)
+		break
+	}
+	syzygyMutex.Lock()
+	syzygyPath, _ = filepath.Abs(*syzygyDir)
+	syzygyMutex.Unlock()
+}
+
+// setSyzygyPaths points any --syzygy-paths in params to the local
+// tablebases, or drops it if they are not available.
+func setSyzygyPaths(params []string) []string {
+	syzygyMutex.Lock()
+	tbPath := syzygyPath
+	syzygyMutex.Unlock()
+	var result []string
+	for _, param := range params {
+		if strings.HasPrefix(param, "--syzygy-paths") {
+			if tbPath == "" {
+				schedulerLog.Warnf("Server asked for tablebases, but none are available")
+				continue
+			}
+			param = "--syzygy-paths=" + tbPath
+		}
+		result = append(result, param)
+	}
+	return result
+}
+
+// worker plays games on one GPU, or on the GPU lc0 picks by default.
+type worker struct {
+	gpu             int
+	pendingNextGame *client.NextGameResponse
+	// The networks of the last game, to notice changes.
+	lastSha          string
+	lastCandidateSha string
+	// The network last used, to log its details when it changes.
+	netPath string
+	// When the backend of this GPU was last self checked.
+	lastSelfCheck time.Time
+	// Games until the next spot check.
+	spotCountdown int
+	// The last tuning result and what it was for, so that failed tuning is
+	// not repeated.
+	tunedKey autotune.Key
+	tuned    *autotune.Config
+}
+
+// run plays games until the client exits, backing off after errors.
+func (w *worker) run(httpClient *http.Client) {
+	errCount := 0
+	backoff := crashloop.Backoff{Min: 10 * time.Second, Max: *maxBackoff}
+	var failures []*lc0Failure
+	for i := 0; ; i++ {
+		err := w.nextGame(httpClient, i)
+		if err != nil {
+			if err.Error() == "retry" {
+				time.Sleep(1 * time.Second)
+				continue
+			}
+			schedulerLog.Errorf("%v", err)
+			status.SetError(err)
+			w.setError(err)
+			errCount++
+			if errCount >= repeatedErrorLimit {
+				webhook.Send(webhook.RepeatedErrors, fmt.Sprintf("%d errors in a row, the last one: %v", errCount, err), nil)
+			}
+			if failure, ok := err.(*lc0Failure); ok {
+				failures = append(failures, failure)
+				if len(failures) == crashLoopLimit {
+					reportCrashLoop(failures, w.gpu)
+					failures = nil
+				}
+			} else {
+				failures = nil
+			}
+			delay := backoff.Next()
+			schedulerLog.Infof("Sleeping for %v...", delay.Round(time.Second))
+			back := stepAway()
+			time.Sleep(delay)
+			back()
+			continue
+		}
+		errCount = 0
+		failures = nil
+		backoff.Reset()
+	}
+}
+
+// addGame counts a finished game in the worker status.
+func (w *worker) addGame() {
+	if multiGpu {
+		status.UpdateWorker(w.gpu, func(ws *status.Worker) {
+			ws.Games++
+		})
+	}
+}
+
+// setError shows err in the worker status.
+func (w *worker) setError(err error) {
+	if multiGpu {
+		status.UpdateWorker(w.gpu, func(ws *status.Worker) {
+			ws.LastError = err.Error()
+		})
+	}
+}
+
+// parseGpus returns the GPUs given with --gpus, detecting them for "all".
+func parseGpus(httpClient *http.Client) []int {
+	if *gpus == "all" {
+		return detectGpus(httpClient)
+	}
+	var list []int
+	for _, s := range strings.Split(*gpus, ",") {
+		g, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || g < 0 {
+			clientLog.Fatalf("Invalid GPU %q in --gpus, use \"all\" or a list like 0,1,3", s)
+		}
+		if !claimGpu(g) {
+			clientLog.Fatalf("GPU %d in --gpus is used by another client on this machine (see --gpu-lock-dir)", g)
+		}
+		list = append(list, g)
+	}
+	return list
+}
+
+// probeGpu runs a tiny benchmark on gpu with backend, returning the device
+// name lc0 reports.
+func probeGpu(networkPath string, backend string, gpu int) (string, error) {
+	cmd := exec.Command(lc0Exe, "benchmark", "-w", networkPath, "--backend="+backend,
+		fmt.Sprintf("--backend-opts=gpu=%d", gpu), "--nodes=1",
+		"--fen=rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 0 1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", err
+	}
+	device := "unknown device"
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "GPU: ") {
+			device = strings.TrimPrefix(line, "GPU: ")
+		} else if strings.HasPrefix(line, "Selected device: ") {
+			device = strings.TrimPrefix(line, "Selected device: ")
+		}
+	}
+	return device, nil
+}
+
+// probeNetwork downloads the current network to probe GPUs with.
+func probeNetwork(httpClient *http.Client) string {
+	backoff := crashloop.Backoff{Min: 10 * time.Second, Max: *maxBackoff}
+	for {
+		ngr, err := client.NextGame(httpClient, *hostname, getExtraParams())
+		if err == nil {
+			markServerContact()
+			var networkPath string
+			networkPath, err = getNetwork(httpClient, ngr.Sha, inf)
+			if err == nil {
+				return networkPath
+			}
+		}
+		delay := backoff.Next()
+		schedulerLog.Warnf("Unable to get a network to probe GPUs with: %v, trying again in %v", err, delay.Round(time.Second))
+		time.Sleep(delay)
+	}
+}
+
+// claimGpu takes the lock of gpu, unless another client on this machine
+// holds it. Without a lock directory every GPU is free.
+func claimGpu(gpu int) bool {
+	if *gpuLockDir == "" {
+		return true
+	}
+	if err := os.MkdirAll(*gpuLockDir, 0777); err != nil {
+		clientLog.Fatalf("Unable to create the GPU lock directory: %v", err)
+	}
+	lock, success, err := acquireLock(*gpuLockDir, fmt.Sprintf("gpu-%d", gpu))
+	if err != nil {
+		clientLog.Fatalf("Unable to lock GPU %d: %v", gpu, err)
+	}
+	if success {
+		gpuLocks = append(gpuLocks, lock)
+	}
+	return success
+}
+
+// assignGpu claims the first GPU no other client on this machine uses, and
+// waits while all of them are in use.
+func assignGpu(httpClient *http.Client) {
+	backend := backendName(*gpu)
+	networkPath := probeNetwork(httpClient)
+	for {
+		count := maxGpus
+		for g := 0; g < maxGpus; g++ {
+			if !claimGpu(g) {
+				continue
+			}
+			device, err := probeGpu(networkPath, backend, g)
+			if err == nil {
+				engineLog.Infof("Claimed GPU %d: %s", g, device)
+				*gpu = g
+				return
+			}
+			gpuLocks[len(gpuLocks)-1].Unlock()
+			gpuLocks = gpuLocks[:len(gpuLocks)-1]
+			if g == 0 {
+				engineLog.Warnf("Unable to probe GPU 0, leaving the choice to lc0: %v", err)
+				return
+			}
+			// Probing fails past the last GPU.
+			engineLog.Debugf("Probing GPU %d: %v", g, err)
+			count = g
+			break
+		}
+		engineLog.Warnf("There are no more GPUs, all %d are in use by other clients, checking again in 60 seconds", count)
+		time.Sleep(60 * time.Second)
+	}
+}
+
+// detectGpus finds the GPUs lc0 can use by probing one after the other until
+// one fails, skipping those other clients on this machine use. This needs a
+// network, so it downloads the current one first.
+func detectGpus(httpClient *http.Client) []int {
+	backend := backendName(*gpu)
+	if backend == "default" {
+		clientLog.Fatalf("--gpus=all needs a GPU backend")
+	}
+	networkPath := probeNetwork(httpClient)
+	var list []int
+	for g := 0; g < maxGpus; g++ {
+		device, err := probeGpu(networkPath, backend, g)
+		if err != nil {
+			engineLog.Debugf("Probing GPU %d: %v", g, err)
+			break
+		}
+		if !claimGpu(g) {
+			engineLog.Infof("Found GPU %d: %s, but another client is using it", g, device)
+			continue
+		}
+		engineLog.Infof("Found GPU %d: %s", g, device)
+		list = append(list, g)
+	}
+	if len(list) == 0 {
+		engineLog.Fatalf("No GPU found with the %s backend", backend)
+	}
+	return list
+}
+
+// tune returns the settings autotuning found best for selfplay with params
+// on this worker's GPU, tuning first if the GPU, lc0 or the network
+// architecture changed. It returns nil to use the defaults.
+func (w *worker) tune(networkPath string, params []string) *autotune.Config {
+	if tuneStore == nil || *parallel > 0 || *backopts != "" {
+		return nil
+	}
+	rule := policyFor(networkPath, w.gpu)
+	if rule != nil && (rule.Parallelism > 0 || rule.BackendOpts != "") {
+		return nil
+	}
+	backend := backendFor(rule, w.gpu)
+	if backend == "default" {
+		return nil
+	}
+	info, err := netinfo.ReadFile(networkPath)
+	if err != nil {
+		engineLog.Warnf("Not tuning, unable to read network info: %v", err)
+		return nil
+	}
+	device := gpuDevice(networkPath, w.gpu)
+	if device == "" {
+		engineLog.Warnf("Not tuning, the GPU is unknown")
+		return nil
+	}
+	if rule != nil {
+		params = append(append([]string{}, rule.Lc0Flags...), params...)
+	}
+	key := autotune.Key{Device: device, Backend: backend, Lc0Version: lc0Caps.Version, Architecture: info.Architecture()}
+	if key == w.tunedKey {
+		return w.tuned
+	}
+	w.tunedKey = key
+	w.tuned = nil
+	// A trial warms up for at most twice its length.
+	trials := autotune.Trials(backend)
+	engineLog.Infof("Tuning %d configurations for %s, this takes %v to %v", trials, key,
+		time.Duration(trials)**autotuneTrial, time.Duration(3*trials)**autotuneTrial)
+	defer stepAway()()
+	result, err := tuneStore.Tune(key, autotune.Batches(backend), func(config autotune.Config) (float64, error) {
+		engineLog.Infof("Tuning: trying %v for %v after warming up", config, *autotuneTrial)
+		return runTrial(networkPath, params, w.gpu, backend, config)
+	}, func(config autotune.Config, err error) {
+		engineLog.Warnf("Tuning: %v failed: %v", config, err)
+	})
+	if err != nil {
+		engineLog.Warnf("Tuning %s failed, using the default settings: %v", key, err)
+		return nil
 	}
-	// Ensure tmpfile is erased
-	os.Remove(out.Name())
+	engineLog.Infof("Tuned %s: %v, %.0f games/hour", key, result.Config, result.GamesPerHour)
+	w.tuned = &result.Config
+	return w.tuned
+}
 
-	return checkValidBook(path, sha)
+// runTrial plays selfplay games with params and config without keeping them,
+// and returns the games per hour. It warms up until each of the games played
+// in parallel has finished once, so that unfinished games weigh the same at
+// the start and end of the trial, and then counts games for --autotune-trial.
+func runTrial(networkPath string, params []string, gpu int, backend string, config autotune.Config) (float64, error) {
+	cmd := exec.Command(lc0Exe, "selfplay")
+	var extra []string
+	if config.BackendOpts != "" {
+		extra = append(extra, config.BackendOpts)
+	}
+	if opts := backendOpts(gpu, backend, extra...); opts != "" {
+		cmd.Args = append(cmd.Args, fmt.Sprintf("--backend-opts=%s", opts))
+	}
+	cmd.Args = append(cmd.Args, fmt.Sprintf("--parallelism=%d", config.Parallelism))
+	cmd.Args = append(cmd.Args, params...)
+	cmd.Args = append(cmd.Args, fmt.Sprintf("--weights=%s", networkPath))
+	engineLog.Debugf("Args: %v", cmd.Args)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	kill := func() {
+		cmd.Process.Kill()
+	}
+	timer := time.AfterFunc(2**autotuneTrial, kill)
+	var measured time.Time
+	warmup := 0
+	games := 0
+	var tail []string
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "gameready ") {
+			if !measured.IsZero() {
+				games++
+			} else {
+				warmup++
+				if warmup >= config.Parallelism && timer.Stop() {
+					measured = time.Now()
+					timer = time.AfterFunc(*autotuneTrial, kill)
+				}
+			}
+		}
+		tail = append(tail, line)
+		if len(tail) > 20 {
+			tail = tail[1:]
+		}
+	}
+	err = cmd.Wait()
+	if !timer.Stop() {
+		// Killed at the end of the trial, as intended.
+		err = nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%s (%v)", crashloop.Classify(tail, err), err)
+	}
+	if measured.IsZero() {
+		return 0, fmt.Errorf("only %d of %d warm-up games finished in %v", warmup, config.Parallelism, time.Since(start).Round(time.Second))
+	}
+	elapsed := time.Since(measured)
+	if games == 0 {
+		return 0, fmt.Errorf("no game finished in %v", elapsed.Round(time.Second))
+	}
+	return float64(games) / elapsed.Hours(), nil
 }
 
-func nextGame(httpClient *http.Client, count int) error {
+func (w *worker) nextGame(httpClient *http.Client, count int) error {
 	var nextGame client.NextGameResponse
 	var err error
-	if pendingNextGame != nil {
-		nextGame = *pendingNextGame
-		pendingNextGame = nil
+	if w.pendingNextGame != nil {
+		nextGame = *w.pendingNextGame
+		w.pendingNextGame = nil
 		err = nil
 	} else {
-		nextGame, err = client.NextGame(httpClient, *hostname, getExtraParams())
+		nextGame, err = client.NextGame(httpClient, *hostname, extraParamsFor(w.gpu))
 		if err != nil {
 			return err
 		}
+		markServerContact()
 	}
+	checkServerLc0Version(nextGame)
 	var serverParams []string
 	err = json.Unmarshal([]byte(nextGame.Params), &serverParams)
 	if err != nil {
 		return err
 	}
-	log.Printf("serverParams: %s", serverParams)
+	schedulerLog.Debugf("serverParams: %s", serverParams)
+
+	networkIdGauge.Set(float64(nextGame.NetworkId))
+	status.Update(func(s *status.Status) {
+		s.Task = nextGame.Type
+		s.RunId = nextGame.TrainingId
+		s.NetworkId = nextGame.NetworkId
+		s.NetworkSha = nextGame.Sha
+		s.CandidateSha = nextGame.CandidateSha
+	})
+	if multiGpu {
+		status.UpdateWorker(w.gpu, func(ws *status.Worker) {
+			ws.Task = nextGame.Type
+			ws.NetworkId = nextGame.NetworkId
+		})
+	}
+	if nextGame.Sha != w.lastSha || nextGame.CandidateSha != w.lastCandidateSha {
+		data := gameData(nextGame)
+		data["previous_sha"] = w.lastSha
+		data["previous_candidate_sha"] = w.lastCandidateSha
+		hooks.Run(hooks.NetworkChanged, data)
+		w.lastSha = nextGame.Sha
+		w.lastCandidateSha = nextGame.CandidateSha
+	}
+	cacheMutex.Lock()
+	inUseFiles[w.gpu] = gameFiles(nextGame)
+	cacheMutex.Unlock()
+	back := stepAway()
+	preflight()
+	back()
 
 	if nextGame.BookUrl != "" {
-		book, err := getBook(&http.Client{}, nextGame.BookUrl, nextGame.BookSha)
+		bookPath, err := getBook(httpClient, nextGame.BookUrl, nextGame.BookSha)
 		if err != nil {
 			return err
 		}
 		// Replace the book file with the correct path
 		for i := range serverParams {
-			if strings.HasPrefix(serverParams[i], "--openings-pgn=") {
-				serverParams[i] = "--openings-pgn=" + book
-				break
+			if m := bookParamRegex.FindString(serverParams[i]); m != "" {
+				serverParams[i] = m + bookPath
 			}
 		}
 	}
 
+	serverParams, err = fetchArtifacts(httpClient, nextGame.Artifacts, serverParams)
+	if err != nil {
+		return err
+	}
+	serverParams = setSyzygyPaths(serverParams)
+
 	if nextGame.Type == "match" {
-		log.Println("Getting networks for match")
+		schedulerLog.Infof("Getting networks for match")
 		networkPath, err := getNetwork(httpClient, nextGame.Sha, inf)
 		if err != nil {
 			return err
@@ -1025,13 +3160,15 @@ func nextGame(httpClient *http.Client, count int) error {
 		if err != nil {
 			return err
 		}
-		log.Println("Starting match")
-		possibleNextGame, err := playMatch(httpClient, nextGame, networkPath, candidatePath, serverParams)
+		w.logNetworkInfo(candidatePath)
+		w.periodicSelfCheck(candidatePath)
+		schedulerLog.Infof("Starting match")
+		possibleNextGame, err := w.playMatch(httpClient, nextGame, networkPath, candidatePath, serverParams)
 		if err != nil {
-			log.Printf("playMatch: %v", err)
+			schedulerLog.Errorf("playMatch: %v", err)
 			return err
 		}
-		pendingNextGame = possibleNextGame
+		w.pendingNextGame = possibleNextGame
 		return nil
 	}
 
@@ -1048,6 +3185,8 @@ func nextGame(httpClient *http.Client, count int) error {
 		if err != nil {
 			return err
 		}
+		w.logNetworkInfo(networkPath)
+		w.periodicSelfCheck(networkPath)
 		otherNetPath := ""
 		if nextGame.CandidateSha != "" {
 			otherNetPath, err = getNetwork(httpClient, nextGame.CandidateSha, inf)
@@ -1064,15 +3203,20 @@ func nextGame(httpClient *http.Client, count int) error {
 				if nextGame.Type == "Done" {
 					return
 				}
-				ng, err := client.NextGame(httpClient, *hostname, getExtraParams())
+				if err := checkResources(); err != nil {
+					schedulerLog.Errorf("%v, stopping training", err)
+					return
+				}
+				ng, err := client.NextGame(httpClient, *hostname, extraParamsFor(w.gpu))
 				if err != nil {
-					fmt.Printf("Error talking to server: %v\n", err)
+					schedulerLog.Warnf("Error talking to server: %v", err)
 					errCount++
 					if errCount < 10 {
 						continue
 					}
 					return
 				}
+				markServerContact()
 				if ng.Type != nextGame.Type || ng.Sha != nextGame.Sha {
 					// Prefetch the next net before terminating game.
 					if ng.Type == "match" {
@@ -1080,13 +3224,13 @@ func nextGame(httpClient *http.Client, count int) error {
 					} else {
 						getNetwork(httpClient, ng.Sha, inf)
 					}
-					pendingNextGame = &ng
+					w.pendingNextGame = &ng
 					return
 				}
 				errCount = 0
 			}
 		}()
-		err = train(httpClient, nextGame, networkPath, otherNetPath, count, serverParams, doneCh)
+		err = w.train(httpClient, nextGame, networkPath, otherNetPath, count, serverParams, doneCh)
 		// Ensure the anonymous function stops retrying.
 		nextGame.Type = "Done"
 		if err != nil {
@@ -1098,10 +3242,209 @@ func nextGame(httpClient *http.Client, count int) error {
 	return errors.New("Unknown game type: " + nextGame.Type)
 }
 
+// serveHTTP serves handler for pattern on addr. Features configured with the
+// same address share one server.
+func serveHTTP(addr string, pattern string, handler http.Handler) {
+	mux, ok := httpMuxes[addr]
+	if !ok {
+		mux = http.NewServeMux()
+		httpMuxes[addr] = mux
+		go func() {
+			clientLog.Fatalf("%v", http.ListenAndServe(addr, mux))
+		}()
+		clientLog.Infof("Serving on http://%s", addr)
+	}
+	mux.Handle(pattern, handler)
+}
+
+func setupLogging() {
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		clientLog.Fatalf("%v", err)
+	}
+	if *debug {
+		level = logging.Debug
+		*transcripts = true
+		if *logDir == "" {
+			*logDir = "logs"
+		}
+	}
+	logging.SetLevel(level)
+	logging.SetJSON(*logJSON)
+	if *logDir != "" {
+		file, err := logging.NewRotatingFile(*logDir, "client", int64(*logMaxSize)<<20, *logMaxAge, *logKeep)
+		if err != nil {
+			clientLog.Fatalf("Unable to open log file: %v", err)
+		}
+		logging.SetOutput(io.MultiWriter(os.Stderr, file))
+	} else if *transcripts {
+		clientLog.Fatalf("--lc0-transcripts needs --log-dir")
+	}
+	// Anything still using the standard logger goes through here too.
+	log.SetFlags(0)
+	log.SetOutput(clientLog.Writer(logging.Info))
+	switch *lc0Output {
+	case "":
+	case "stdout":
+		logging.SetEngineOutput(os.Stdout)
+	case "stderr":
+		logging.SetEngineOutput(os.Stderr)
+	default:
+		file, err := os.OpenFile(*lc0Output, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			clientLog.Fatalf("Unable to open lc0 output file: %v", err)
+		}
+		logging.SetEngineOutput(file)
+	}
+}
+
+// setupHooks makes the client exiting hooks run on fatal errors and signals.
+func setupHooks() {
+	hooks.SetTimeout(*hookTimeout)
+	logging.OnFatal(func(msg string) {
+		hooks.NotifyExit(1, msg)
+	})
+	// Stop lc0 too when asked to stop, so containers shut down cleanly.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		clientLog.Infof("Received %v, exiting", sig)
+		killAll()
+		hooks.Exit(0, sig.String())
+	}()
+}
+
+// setupHealth registers the readiness checks and serves the health
+// endpoints.
+func setupHealth() {
+	health.Register("server", func() error {
+		contactMutex.Lock()
+		defer contactMutex.Unlock()
+		if lastContact.IsZero() {
+			return errors.New("no answer from the server yet")
+		}
+		if time.Since(lastContact) > *serverTimeout {
+			return fmt.Errorf("no answer from the server since %s", lastContact.Format(time.RFC3339))
+		}
+		return nil
+	})
+	health.Register("lc0", func() error {
+		progressMutex.Lock()
+		defer progressMutex.Unlock()
+		if len(runningLc0) == 0 && awayFromLc0 == 0 && time.Since(lc0LastRunning) > *readyGrace {
+			return fmt.Errorf("lc0 is not running since %s", lc0LastRunning.Format(time.RFC3339))
+		}
+		for c := range runningLc0 {
+			if c.watch == nil {
+				continue
+			}
+			if stalled, since := c.watch.Stalled(); stalled {
+				return fmt.Errorf("lc0 printed nothing since %s", since.Format(time.RFC3339))
+			}
+		}
+		return nil
+	})
+	serveHTTP(*healthAddr, "/healthz", health.LiveHandler())
+	serveHTTP(*healthAddr, "/readyz", health.ReadyHandler())
+}
+
+// runPrintBackendOpts implements --print-backend-opts, printing the backend
+// options launch generates for each GPU before policy rules and tuning.
+func runPrintBackendOpts() int {
+	list := []int{*gpu}
+	if *gpus != "" && *gpus != "all" {
+		list = nil
+		for _, s := range strings.Split(*gpus, ",") {
+			g, err := strconv.Atoi(strings.TrimSpace(s))
+			if err != nil {
+				clientLog.Errorf("Invalid GPU %q in --gpus", s)
+				return 1
+			}
+			list = append(list, g)
+		}
+	}
+	for _, g := range list {
+		opts := backendOpts(g, selectedBackend(g))
+		if _, err := backendopts.Validate(opts); err != nil {
+			clientLog.Errorf("Invalid backend options, %v", err)
+			return 1
+		}
+		if len(list) > 1 {
+			fmt.Printf("gpu %d: ", g)
+		}
+		if opts == "" {
+			fmt.Printf("(none, lc0 uses its default backend)\n")
+		} else {
+			fmt.Printf("%s\n", opts)
+		}
+	}
+	if policyFile != nil {
+		fmt.Fprintf(os.Stderr, "Rules of %s may change this at each launch\n", *policyPath)
+	}
+	if tuneStore != nil {
+		fmt.Fprintf(os.Stderr, "Tuning may add batch options\n")
+	}
+	return 0
+}
+
+// runHealthcheck implements the healthcheck subcommand, which queries the
+// health endpoints of a running client and exits with 1 if it is unhealthy.
+func runHealthcheck(args []string) int {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	live := fs.Bool("live", false, "Only check that the client is alive, not that it is working")
+	timeout := fs.Duration("timeout", 10*time.Second, "How long to wait for an answer")
+	fs.Parse(args)
+	if *healthAddr == "" {
+		clientLog.Errorf("Give the address the client serves health endpoints on with --health-addr")
+		return 1
+	}
+	addr := *healthAddr
+	if strings.HasPrefix(addr, ":") {
+		addr = "localhost" + addr
+	}
+	endpoint := "/readyz"
+	if *live {
+		endpoint = "/healthz"
+	}
+	if err := health.Query("http://"+addr+endpoint, *timeout); err != nil {
+		clientLog.Errorf("Unhealthy: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// webhookSource names this client in webhook notifications.
+func webhookSource() string {
+	host := *localHost
+	if host == "" || host == defaultLocalHost {
+		host, _ = os.Hostname()
+	}
+	if *user == "" {
+		return host
+	}
+	return *user + "@" + host
+}
+
+// runWebhookTest implements the webhook-test subcommand, which sends a test
+// notification to the configured webhooks.
+func runWebhookTest() int {
+	if !webhook.Enabled() {
+		clientLog.Errorf("No webhooks configured, use --webhook")
+		return 1
+	}
+	webhook.SetSource(webhookSource())
+	if err := webhook.SendAndWait(webhook.Test, "This is a test notification", nil); err != nil {
+		return 1
+	}
+	clientLog.Infof("Test notification sent")
+	return 0
+}
+
 // Ensure Tilps/chess is new enough.
 func testChessVersion() {
 	if chess.GetLibraryVersion() < 3 {
-		log.Fatal("You need a more recent version of package github.com/Tilps/chess")
+		clientLog.Fatalf("You need a more recent version of package github.com/Tilps/chess")
 	}
 }
 
@@ -1125,9 +3468,43 @@ func maybeSetTrainOnly() {
 			found = true
 		}
 	})
-	if !found && !hasCudnn && !hasCuda && !hasDx {
+	if b := selectedBackend(*gpu); !found && (b == "default" || b == "opencl" || capabilities.IsCPU(b)) {
 		*trainOnly = true
-		log.Println("Will only run training games, use -train-only=false to override")
+		clientLog.Infof("Will only run training games, use -train-only=false to override")
+	}
+}
+
+// setDefaultSettingsPath puts the configuration file in the user's
+// configuration directory, unless --config was given.
+func setDefaultSettingsPath() {
+	if len(*settingsPath) == 0 {
+		*settingsPath = "lc0-training-client-config.json"
+		configDir := ""
+		if runtime.GOOS == "linux" {
+			configDir = os.Getenv("XDG_CONFIG_HOME")
+			if len(configDir) == 0 {
+				homeDir := os.Getenv("HOME")
+				if len(homeDir) != 0 {
+					configDir = homeDir + "/.config"
+				}
+			}
+		} else if runtime.GOOS == "darwin" {
+			homeDir := os.Getenv("HOME")
+			if len(homeDir) != 0 {
+				configDir = homeDir + "/Library/Preferences"
+			}
+		}
+
+		if len(configDir) != 0 {
+			configDir = filepath.Join(configDir, "lc0")
+			_, err := os.Stat(configDir)
+			if os.IsNotExist(err) {
+				err = os.Mkdir(configDir, os.ModePerm)
+			}
+			if err == nil {
+				*settingsPath = filepath.Join(configDir, *settingsPath)
+			}
+		}
 	}
 }
 
@@ -1136,6 +3513,10 @@ func main() {
 
 	testChessVersion()
 
+	flag.Var(hookFlag{}, "hook", "Run a command on a client event, given as event=command (can be repeated).\n"+
+		"Events: network-changed, game-uploaded, upload-failed, lc0-crashed, upgrade-required, client-exiting")
+	flag.Var(webhookFlag{}, "webhook", "Url to post notifications about problems to, optionally prefixed with the format\n"+
+		"as in slack=https://... (json, slack or discord, guessed from the url by default; can be repeated)")
 	hideLc0argsFlag()
 	flag.Parse()
 
@@ -1143,21 +3524,80 @@ func main() {
 		return
 	}
 
-	if runtime.GOOS == "windows" {
-		lc0Exe = "lc0.exe"
+	setupLogging()
+	setupHooks()
+	webhook.SetMinInterval(*webhookPeriod)
+
+	if flag.Arg(0) == "netinfo" {
+		os.Exit(runNetInfo(flag.Args()[1:]))
+	}
+
+	setDefaultSettingsPath()
+	if len(*statsPath) == 0 {
+		*statsPath = filepath.Join(filepath.Dir(*settingsPath), "lc0-training-client-stats.json")
+	}
+	statsStore = stats.Open(*statsPath)
+	if flag.Arg(0) == "stats" {
+		os.Exit(runStats(flag.Args()[1:]))
+	}
+
+	if flag.Arg(0) == "webhook-test" {
+		os.Exit(runWebhookTest())
+	}
+	if flag.Arg(0) == "healthcheck" {
+		os.Exit(runHealthcheck(flag.Args()[1:]))
+	}
+
+	if flag.Arg(0) == "lc0" {
+		os.Exit(runLc0Command(flag.Args()[1:]))
+	}
+
+	var err error
+	if *lc0Dir != "" {
+		lc0Exe, err = openLc0Manager().Update(lc0version.Builtin.Minimum)
+		if err != nil {
+			engineLog.Fatalf("%v", err)
+		}
+	} else {
+		if runtime.GOOS == "windows" {
+			lc0Exe = "lc0.exe"
+		}
+		dir, _ := os.Getwd()
+		fi, err := os.Stat(path.Join(dir, lc0Exe))
+		if err == nil && !fi.Mode().IsDir() {
+			lc0Exe = path.Join(dir, lc0Exe)
+		}
+	}
+	if *backopts != "" {
+		if _, err := backendopts.Validate(*backopts); err != nil {
+			clientLog.Fatalf("Invalid --backend-opts, %v", err)
+		}
 	}
-	dir, _ := os.Getwd()
-	fi, err := os.Stat(path.Join(dir, lc0Exe))
-	if err == nil && !fi.Mode().IsDir() {
-		lc0Exe = path.Join(dir, lc0Exe)
+	if err := backendopts.CheckFlags(strings.Fields(*lc0Args)); err != nil {
+		clientLog.Fatalf("Invalid --lc0args, %v", err)
 	}
 	checkLc0()
+	if *policyPath != "" {
+		policyFile, err = policy.Open(*policyPath)
+		if err != nil {
+			clientLog.Fatalf("Unable to read the policy: %v", err)
+		}
+	}
+	if *autotuneOn {
+		if len(*autotunePath) == 0 {
+			*autotunePath = filepath.Join(filepath.Dir(*settingsPath), "lc0-training-client-autotune.json")
+		}
+		tuneStore = autotune.Open(*autotunePath)
+	}
+	if *printOpts {
+		os.Exit(runPrintBackendOpts())
+	}
 
 	maybeSetTrainOnly()
 
 	// 640 ought to be enough for anybody.
 	if *runId > 640 {
-		log.Fatal("Training run number too large")
+		clientLog.Fatalf("Training run number too large")
 	}
 	randBytes := make([]byte, 2)
 	_, err = rand.Reader.Read(randBytes)
@@ -1175,38 +3615,6 @@ func main() {
 		*networkMirror = *hostname + "/get_network?sha="
 	}
 
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-
-	if len(*settingsPath) == 0 {
-		*settingsPath = "lc0-training-client-config.json"
-		configDir := ""
-		if runtime.GOOS == "linux" {
-			configDir = os.Getenv("XDG_CONFIG_HOME")
-			if len(configDir) == 0 {
-				homeDir := os.Getenv("HOME")
-				if len(homeDir) != 0 {
-					configDir = homeDir + "/.config"
-				}
-			}
-		} else if runtime.GOOS == "darwin" {
-			homeDir := os.Getenv("HOME")
-			if len(homeDir) != 0 {
-				configDir = homeDir + "/Library/Preferences"
-			}
-		}
-
-		if len(configDir) != 0 {
-			configDir = filepath.Join(configDir, "lc0")
-			_, err = os.Stat(configDir)
-			if os.IsNotExist(err) {
-				err = os.Mkdir(configDir, os.ModePerm)
-			}
-			if err == nil {
-				*settingsPath = filepath.Join(configDir, *settingsPath)
-			}
-		}
-	}
-
 	settingsUser, settingsPassword, settingsHost := readSettings(*settingsPath)
 	if len(*user) == 0 || len(*password) == 0 {
 		*user = settingsUser
@@ -1222,10 +3630,10 @@ func main() {
 	}
 
 	if len(*user) == 0 {
-		log.Fatal("You must specify a username")
+		clientLog.Fatalf("You must specify a username")
 	}
 	if len(*password) == 0 {
-		log.Fatal("You must specify a non-empty password")
+		clientLog.Fatalf("You must specify a non-empty password")
 	}
 
 	if *report_host && len(*localHost) == 0 {
@@ -1238,20 +3646,40 @@ func main() {
 	if len(*localHost) == 0 {
 		*localHost = defaultLocalHost
 	}
+	webhook.SetSource(webhookSource())
+
+	if *metricsAddr != "" {
+		serveHTTP(*metricsAddr, "/metrics", metrics.Handler())
+	}
+	if *statusAddr != "" {
+		serveHTTP(*statusAddr, "/status", status.Handler())
+		serveHTTP(*statusAddr, "/", status.PageHandler("/status"))
+	}
+	if *healthAddr != "" {
+		setupHealth()
+	}
 
 	httpClient := &http.Client{Timeout: 300 * time.Second}
+	if *syzygyDir != "" {
+		go provisionTablebases(httpClient)
+	}
 	startTime = time.Now()
-	for i := 0; ; i++ {
-		err := nextGame(httpClient, i)
-		if err != nil {
-			if err.Error() == "retry" {
-				time.Sleep(1 * time.Second)
-				continue
-			}
-			log.Print(err)
-			log.Print("Sleeping for 30 seconds...")
-			time.Sleep(30 * time.Second)
-			continue
+	if *gpus == "" {
+		if *gpu < 0 && *backopts == "" && *gpuLockDir != "" && backendName(*gpu) != "default" {
+			assignGpu(httpClient)
 		}
+		if *gpu >= 0 && *backopts == "" && !claimGpu(*gpu) {
+			clientLog.Fatalf("GPU %d in --gpu is used by another client on this machine (see --gpu-lock-dir)", *gpu)
+		}
+		(&worker{gpu: *gpu}).run(httpClient)
+	}
+	if *gpu >= 0 || *backopts != "" {
+		clientLog.Fatalf("--gpus cannot be combined with --gpu or --backend-opts")
+	}
+	list := parseGpus(httpClient)
+	multiGpu = true
+	for _, g := range list {
+		go (&worker{gpu: g}).run(httpClient)
 	}
+	select {}
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// The position after 1. e4 e5, as an EPD book gives it.
+const bookFen = "rnbqkbnr/pppp1ppp/8/4p3/4P3/8/PPPP1PPP/RNBQKBNR w KQkq e6 0 2"
+
+func TestGamePositions(t *testing.T) {
+	tests := []struct {
+		name  string
+		moves string
+		want  []string
+	}{
+		{"start position", "e2e4 e7e5 g1f3", []string{
+			"position startpos",
+			"position startpos moves e2e4",
+			"position startpos moves e2e4 e7e5",
+		}},
+		{"book position", "g1f3 b8c6 from_fen " + bookFen, []string{
+			"position fen " + bookFen,
+			"position fen " + bookFen + " moves g1f3",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			positions, err := gamePositions(strings.Fields(tt.moves))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range positions {
+				got = append(got, p.uci)
+				if countPieces(p.fen) != 32 {
+					t.Errorf("%s: %d pieces, want 32", p.fen, countPieces(p.fen))
+				}
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("gamePositions() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if _, err := gamePositions([]string{"e2e5"}); err == nil {
+		t.Error("gamePositions() of an illegal move succeeded")
+	}
+}
+
+// TestEvaluateOnCPUHistory replays the positions of a game after its book
+// moves, as spot checks do, and checks that lc0 is given the moves from the
+// book position, so that the network sees the same history as in selfplay.
+func TestEvaluateOnCPUHistory(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake lc0 is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "spotcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	received := filepath.Join(dir, "received")
+	fake := filepath.Join(dir, "lc0")
+	script := `#!/bin/sh
+while read -r line; do case "$line" in
+  position*) echo "$line" >> ` + received + `;;
+  go*) echo "info string e2e4  (322 ) N:       0 (+ 0) (P: 50.00%) (Q:  -.-----)"
+       echo "info depth 1 seldepth 1 time 3 nodes 1 score cp 1234 nps 300 pv e2e4"
+       echo "bestmove e2e4";;
+  quit) exit 0;;
+esac; done
+`
+	if err := ioutil.WriteFile(fake, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	savedExe, savedRef := lc0Exe, *checkRef
+	defer func() { lc0Exe, *checkRef = savedExe, savedRef }()
+	lc0Exe, *checkRef = fake, "eigen"
+
+	// Two book moves from the start position, then two played by lc0.
+	positions, err := gamePositions(strings.Fields("d2d4 d7d5 c2c4 e7e6"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	evals, err := evaluateOnCPU("net.pb.gz", positions[2:], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evals) != 2 || evals[1].q != 0.1234 || evals[1].policy[322] != 0.5 {
+		t.Errorf("evaluateOnCPU() = %+v, want 2 evaluations with q 0.1234 and a prior of 0.5", evals)
+	}
+	b, err := ioutil.ReadFile(received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "position startpos moves d2d4 d7d5\nposition startpos moves d2d4 d7d5 c2c4\n"
+	if string(b) != want {
+		t.Errorf("lc0 was sent %q, want %q", b, want)
+	}
+}
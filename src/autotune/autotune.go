@@ -0,0 +1,204 @@
+// Package autotune finds the lc0 parallelism and backend batch options that
+// play the most games per hour, by running short trials of them. The
+// parallelism is searched first, then the batch options with the best
+// parallelism, as trials take minutes each.
+//
+// Results are cached in a JSON file per GPU, backend, lc0 version and network
+// architecture, so tuning runs again only when one of those changes.
+// Clients sharing the file take turns through a lock file.
+package autotune
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// Config is a combination of settings to try.
+type Config struct {
+	Parallelism int
+	// Extra backend options, such as "max_batch=512", or empty for the
+	// backend's defaults.
+	BackendOpts string
+}
+
+func (c Config) String() string {
+	if c.BackendOpts == "" {
+		return fmt.Sprintf("parallelism=%d", c.Parallelism)
+	}
+	return fmt.Sprintf("parallelism=%d %s", c.Parallelism, c.BackendOpts)
+}
+
+// Parallelisms are tried first, with the backend's default batch options.
+var Parallelisms = []int{8, 16, 32, 64}
+
+// Batches returns the batch options to try with the best parallelism. They
+// are only known for the cuda backends.
+func Batches(backend string) []string {
+	if backend == "cuda-auto" || backend == "cudnn-auto" {
+		return []string{"max_batch=256", "max_batch=512"}
+	}
+	return nil
+}
+
+// Trials returns how many trials tuning backend runs.
+func Trials(backend string) int {
+	return len(Parallelisms) + len(Batches(backend))
+}
+
+// Key identifies what the best configuration depends on.
+type Key struct {
+	Device       string
+	Backend      string
+	Lc0Version   string
+	Architecture string
+}
+
+func (k Key) String() string {
+	return fmt.Sprintf("%s, %s backend, lc0 %s, %s", k.Device, k.Backend, k.Lc0Version, k.Architecture)
+}
+
+// Result is the best configuration found for a key.
+type Result struct {
+	Key
+	Config
+	GamesPerHour float64
+	Tuned        time.Time
+}
+
+// Trial runs lc0 with config and returns the games per hour it played.
+type Trial func(config Config) (float64, error)
+
+// Store is a cache file of results.
+type Store struct {
+	path string
+	// Held while tuning a key, so that workers on identical GPUs tune only
+	// once.
+	mutex sync.Mutex
+	busy  map[Key]*sync.Mutex
+}
+
+// Open returns the store kept at path, which is created on the first Save.
+func Open(path string) *Store {
+	return &Store{path: path, busy: map[Key]*sync.Mutex{}}
+}
+
+func (s *Store) read() ([]Result, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var results []Result
+	err = json.Unmarshal(b, &results)
+	return results, err
+}
+
+// Lookup returns the cached result for key, if any.
+func (s *Store) Lookup(key Key) (*Result, error) {
+	lock := flock.New(s.path + ".lck")
+	if err := lock.RLock(); err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	results, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		if results[i].Key == key {
+			return &results[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Save replaces the cached result for r's key.
+func (s *Store) Save(r Result) error {
+	lock := flock.New(s.path + ".lck")
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	results, err := s.read()
+	if err != nil {
+		return err
+	}
+	found := false
+	for i := range results {
+		if results[i].Key == r.Key {
+			results[i] = r
+			found = true
+			break
+		}
+	}
+	if !found {
+		results = append(results, r)
+	}
+	b, err := json.MarshalIndent(results, "", " ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash cannot truncate the cache.
+	tmp := s.path + "_tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *Store) keyMutex(key Key) *sync.Mutex {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m, ok := s.busy[key]
+	if !ok {
+		m = &sync.Mutex{}
+		s.busy[key] = m
+	}
+	return m
+}
+
+// Tune returns the cached result for key, or runs trial for each of
+// Parallelisms and then for each of batches with the best one, and caches
+// the best configuration. Failed trials are reported to failed and skipped.
+// Tune fails only if every parallelism does.
+func (s *Store) Tune(key Key, batches []string, trial Trial, failed func(Config, error)) (*Result, error) {
+	m := s.keyMutex(key)
+	m.Lock()
+	defer m.Unlock()
+	if r, err := s.Lookup(key); err != nil || r != nil {
+		return r, err
+	}
+	var best *Result
+	var lastErr error
+	try := func(config Config) {
+		rate, err := trial(config)
+		if err != nil {
+			failed(config, err)
+			lastErr = err
+			return
+		}
+		if best == nil || rate > best.GamesPerHour {
+			best = &Result{Key: key, Config: config, GamesPerHour: rate}
+		}
+	}
+	for _, p := range Parallelisms {
+		try(Config{Parallelism: p})
+	}
+	if best == nil {
+		return nil, fmt.Errorf("all %d trials failed, the last with: %v", len(Parallelisms), lastErr)
+	}
+	parallelism := best.Parallelism
+	for _, b := range batches {
+		try(Config{Parallelism: parallelism, BackendOpts: b})
+	}
+	best.Tuned = time.Now()
+	return best, s.Save(*best)
+}
@@ -0,0 +1,160 @@
+package autotune
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func tempStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "autotune")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Open(filepath.Join(dir, "autotune.json")), func() { os.RemoveAll(dir) }
+}
+
+var key = Key{Device: "NVIDIA GeForce RTX 4090", Backend: "cuda-auto", Lc0Version: "v0.31.2", Architecture: "15 encoder layers"}
+
+func TestTune(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend string
+		// Games per hour of each configuration, missing ones fail.
+		rates      map[Config]float64
+		want       Config
+		wantTried  int
+		wantFailed int
+		wantErr    bool
+	}{
+		{
+			name:    "parallelism only",
+			backend: "eigen",
+			rates: map[Config]float64{
+				{Parallelism: 8}: 10, {Parallelism: 16}: 30, {Parallelism: 32}: 20, {Parallelism: 64}: 5,
+			},
+			want:      Config{Parallelism: 16},
+			wantTried: 4,
+		},
+		{
+			name:    "batch with the best parallelism",
+			backend: "cuda-auto",
+			rates: map[Config]float64{
+				{Parallelism: 8}: 10, {Parallelism: 16}: 20, {Parallelism: 32}: 40, {Parallelism: 64}: 30,
+				{Parallelism: 32, BackendOpts: "max_batch=256"}: 35,
+				{Parallelism: 32, BackendOpts: "max_batch=512"}: 50,
+				// Never tried, 64 is not the best parallelism.
+				{Parallelism: 64, BackendOpts: "max_batch=512"}: 100,
+			},
+			want:      Config{Parallelism: 32, BackendOpts: "max_batch=512"},
+			wantTried: 6,
+		},
+		{
+			name:    "failed trials are skipped",
+			backend: "cuda-auto",
+			rates: map[Config]float64{
+				{Parallelism: 8}: 10, {Parallelism: 16}: 20,
+				{Parallelism: 16, BackendOpts: "max_batch=256"}: 25,
+			},
+			want:       Config{Parallelism: 16, BackendOpts: "max_batch=256"},
+			wantTried:  6,
+			wantFailed: 3,
+		},
+		{
+			name:       "all fail",
+			backend:    "cuda-auto",
+			rates:      map[Config]float64{},
+			wantTried:  4,
+			wantFailed: 4,
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, cleanup := tempStore(t)
+			defer cleanup()
+			tried, failed := 0, 0
+			trial := func(c Config) (float64, error) {
+				tried++
+				if rate, ok := tt.rates[c]; ok {
+					return rate, nil
+				}
+				return 0, errors.New("out of memory")
+			}
+			r, err := s.Tune(key, Batches(tt.backend), trial, func(Config, error) { failed++ })
+			if tried != tt.wantTried || tried > Trials(tt.backend) || failed != tt.wantFailed {
+				t.Errorf("Tune() ran %d trials with %d failed, want %d with %d failed", tried, failed, tt.wantTried, tt.wantFailed)
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("Tune() = %+v, want an error", r)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Tune() = %v", err)
+			}
+			if r.Config != tt.want || r.GamesPerHour != tt.rates[tt.want] {
+				t.Errorf("Tune() = %v at %.0f games/hour, want %v", r.Config, r.GamesPerHour, tt.want)
+			}
+
+			// Tuned once, the result is cached.
+			again, err := Open(s.path).Tune(key, Batches(tt.backend), trial, func(Config, error) {})
+			if err != nil || again.Config != r.Config || tried != tt.wantTried {
+				t.Errorf("Tune() again = %v, %v after %d trials, want the cached %v", again, err, tried, r.Config)
+			}
+		})
+	}
+}
+
+func TestSaveConcurrently(t *testing.T) {
+	s, cleanup := tempStore(t)
+	defer cleanup()
+	devices := []string{"GPU 0", "GPU 1", "GPU 2"}
+	var wg sync.WaitGroup
+	for i, d := range devices {
+		wg.Add(1)
+		go func(i int, d string) {
+			defer wg.Done()
+			// Each client opens the file on its own, as separate processes do.
+			store := Open(s.path)
+			k := key
+			k.Device = d
+			for p := 1; p <= 5; p++ {
+				if err := store.Save(Result{Key: k, Config: Config{Parallelism: p * (i + 1)}}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i, d)
+	}
+	wg.Wait()
+	for i, d := range devices {
+		k := key
+		k.Device = d
+		r, err := s.Lookup(k)
+		if err != nil || r == nil || r.Parallelism != 5*(i+1) {
+			t.Errorf("Lookup(%s) = %+v, %v, want the last saved parallelism %d", d, r, err, 5*(i+1))
+		}
+	}
+	other := key
+	other.Lc0Version = "v0.32.0"
+	if r, err := s.Lookup(other); err != nil || r != nil {
+		t.Errorf("Lookup() of an untuned key = %+v, %v, want nothing", r, err)
+	}
+}
+
+func TestLookupCorrupt(t *testing.T) {
+	s, cleanup := tempStore(t)
+	defer cleanup()
+	ioutil.WriteFile(s.path, []byte("{"), 0644)
+	if _, err := s.Lookup(key); err == nil {
+		t.Error("Lookup() in a corrupt file succeeded")
+	}
+	if err := s.Save(Result{Key: key}); err == nil {
+		t.Error("Save() to a corrupt file succeeded, losing its results")
+	}
+}
@@ -0,0 +1,334 @@
+// Package backendopts parses and checks lc0 backend options, as given with
+// --backend-opts.
+//
+// The grammar, as read by lc0, is a comma separated list of items, where an
+// item is a key with a value (gpu=1), a key with a nested list
+// (cudnn(gpu=1)) or a bare key (dx12). Nested lists and bare keys define the
+// children of wrapping backends such as multiplexing and check; a child uses
+// the backend named by its backend option, or else by its key.
+//
+// Only backends and keys known to be fine for training are accepted, so that
+// games cannot be played with backends that make up results.
+package backendopts
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Backends that compute real results. The wrapping ones only pass the work
+// on to their children.
+var allowedBackends = map[string]bool{
+	"blas":         true,
+	"check":        true,
+	"cuda":         true,
+	"cuda-auto":    true,
+	"cuda-fp16":    true,
+	"cudnn":        true,
+	"cudnn-auto":   true,
+	"cudnn-fp16":   true,
+	"demux":        true,
+	"dx12":         true,
+	"eigen":        true,
+	"metal":        true,
+	"multiplexing": true,
+	"onnx-cpu":     true,
+	"onnx-cuda":    true,
+	"onnx-dml":     true,
+	"onnx-rocm":    true,
+	"onnx-trt":     true,
+	"opencl":       true,
+	"round-robin":  true,
+	"roundrobin":   true,
+	"sycl":         true,
+}
+
+// Options of the allowed backends.
+var allowedKeys = map[string]bool{
+	"atol":             true,
+	"backend":          true,
+	"batch":            true,
+	"batch_size":       true,
+	"blas_cores":       true,
+	"custom_winograd":  true,
+	"force_tune":       true,
+	"fp16":             true,
+	"freq":             true,
+	"gpu":              true,
+	"max_batch":        true,
+	"min_batch":        true,
+	"mode":             true,
+	"multi_stream":     true,
+	"opset":            true,
+	"provider":         true,
+	"res_block_fusing": true,
+	"rtol":             true,
+	"steps":            true,
+	"threads":          true,
+	"tune_exhaustive":  true,
+	"tune_only":        true,
+}
+
+// Values of the check backend's mode option that still play normal games.
+var allowedModes = map[string]bool{
+	"check":   true,
+	"display": true,
+	"histo":   true,
+}
+
+// Item is a node of parsed options.
+type Item struct {
+	Key string
+	// Set for key=value items.
+	Value    string
+	HasValue bool
+	// Set for key(...) items.
+	Children List
+	// Where the item and its value start in the parsed string.
+	Pos      int
+	ValuePos int
+}
+
+// List is a list of options.
+type List []*Item
+
+// Error points at the part of the options that is wrong.
+type Error struct {
+	Input string
+	Pos   int
+	Msg   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("column %d: %s\n  %s\n  %s^", e.Pos+1, e.Msg, e.Input, strings.Repeat(" ", e.Pos))
+}
+
+type token struct {
+	text string
+	// One of ",=()" for punctuation, "w" for words and "$" at the end.
+	kind byte
+	pos  int
+}
+
+func lex(s string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case strings.IndexByte(",=()", c) >= 0:
+			tokens = append(tokens, token{text: string(c), kind: c, pos: i})
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, &Error{Input: s, Pos: i, Msg: "unterminated quote"}
+			}
+			tokens = append(tokens, token{text: s[i+1 : i+1+end], kind: 'w', pos: i})
+			i += end + 2
+		default:
+			start := i
+			for i < len(s) && strings.IndexByte(",=()\"' \t", s[i]) < 0 {
+				i++
+			}
+			tokens = append(tokens, token{text: s[start:i], kind: 'w', pos: start})
+		}
+	}
+	return append(tokens, token{kind: '$', pos: len(s)}), nil
+}
+
+type parser struct {
+	input  string
+	tokens []token
+	next   int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.next]
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return &Error{Input: p.input, Pos: t.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) list(end byte) (List, error) {
+	var list List
+	for {
+		t := p.peek()
+		if t.kind == end && len(list) == 0 {
+			return list, nil
+		}
+		if t.kind != 'w' {
+			return nil, p.errorf(t, "expected an option name")
+		}
+		p.next++
+		item := &Item{Key: t.text, Pos: t.pos}
+		switch p.peek().kind {
+		case '=':
+			p.next++
+			v := p.peek()
+			if v.kind != 'w' {
+				return nil, p.errorf(v, "expected a value for %s", item.Key)
+			}
+			p.next++
+			item.Value = v.text
+			item.HasValue = true
+			item.ValuePos = v.pos
+		case '(':
+			p.next++
+			children, err := p.list(')')
+			if err != nil {
+				return nil, err
+			}
+			p.next++
+			item.Children = children
+		}
+		list = append(list, item)
+		switch t := p.peek(); t.kind {
+		case ',':
+			p.next++
+		case end:
+			return list, nil
+		default:
+			if end == ')' {
+				return nil, p.errorf(t, "expected , or )")
+			}
+			return nil, p.errorf(t, "expected ,")
+		}
+	}
+}
+
+// Parse parses backend options.
+func Parse(s string) (List, error) {
+	tokens, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{input: s, tokens: tokens}
+	return p.list('$')
+}
+
+func quote(v string) string {
+	if v == "" || strings.ContainsAny(v, ",=()\"' \t") {
+		if strings.Contains(v, "\"") {
+			return "'" + v + "'"
+		}
+		return "\"" + v + "\""
+	}
+	return v
+}
+
+func (l List) String() string {
+	var parts []string
+	for _, item := range l {
+		switch {
+		case item.HasValue:
+			parts = append(parts, item.Key+"="+quote(item.Value))
+		case item.Children != nil:
+			parts = append(parts, item.Key+"("+item.Children.String()+")")
+		default:
+			parts = append(parts, item.Key)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+func names(m map[string]bool) string {
+	var list []string
+	for k := range m {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return strings.Join(list, ", ")
+}
+
+func check(input string, l List) error {
+	errorf := func(pos int, format string, args ...interface{}) error {
+		return &Error{Input: input, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+	}
+	hasBackend := map[*Item]bool{}
+	for _, item := range l {
+		for _, child := range item.Children {
+			if child.Key == "backend" {
+				hasBackend[item] = true
+			}
+		}
+	}
+	for _, item := range l {
+		switch {
+		case item.HasValue:
+			if !allowedKeys[item.Key] {
+				return errorf(item.Pos, "option %q is not allowed, use one of %s", item.Key, names(allowedKeys))
+			}
+			if item.Key == "backend" && !allowedBackends[item.Value] {
+				return errorf(item.ValuePos, "backend %q is not allowed, use one of %s", item.Value, names(allowedBackends))
+			}
+			if item.Key == "mode" && !allowedModes[item.Value] {
+				return errorf(item.ValuePos, "check mode %q is not allowed, use one of %s", item.Value, names(allowedModes))
+			}
+		default:
+			// A child backend, named by its key unless it has a backend
+			// option.
+			if !hasBackend[item] && !allowedBackends[item.Key] {
+				return errorf(item.Pos, "backend %q is not allowed, use one of %s", item.Key, names(allowedBackends))
+			}
+			if err := check(input, item.Children); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Validate parses s and checks that it only uses allowed backends and
+// options.
+func Validate(s string) (List, error) {
+	l, err := Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	return l, check(s, l)
+}
+
+// Long and short names of the lc0 flags that choose the backend, its options
+// or the network.
+var reservedFlags = map[string]bool{
+	"backend":      true,
+	"backend-opts": true,
+	"weights":      true,
+	"b":            true,
+	"o":            true,
+	"w":            true,
+}
+
+// CheckFlags returns an error if any of the lc0 flags in args chooses the
+// backend, its options or the network, in any form lc0 accepts: --name=value,
+// --name value, a player prefix like --player1.name, -x value, -x=value or
+// -xvalue. These must only come from the checked backend options.
+func CheckFlags(args []string) error {
+	for _, arg := range args {
+		var name string
+		switch {
+		case strings.HasPrefix(arg, "--"):
+			name = strings.SplitN(arg[2:], "=", 2)[0]
+			if i := strings.LastIndex(name, "."); i >= 0 {
+				name = name[i+1:]
+			}
+		case strings.HasPrefix(arg, "-") && len(arg) > 1:
+			name = arg[1:2]
+		default:
+			continue
+		}
+		if reservedFlags[strings.ToLower(name)] {
+			return fmt.Errorf("lc0 flag %s is not allowed, the backend, its options and the network are set by the client", arg)
+		}
+	}
+	return nil
+}
+
+// AllowedBackend reports whether backend may be used for training.
+func AllowedBackend(backend string) bool {
+	return allowedBackends[backend]
+}
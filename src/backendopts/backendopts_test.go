@@ -0,0 +1,110 @@
+package backendopts
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input string
+		// The options printed back, or the column of the error.
+		want   string
+		errPos int
+	}{
+		{input: "", want: ""},
+		{input: "gpu=1", want: "gpu=1"},
+		{input: " gpu = 1 , max_batch=512", want: "gpu=1,max_batch=512"},
+		{input: "dx12", want: "dx12"},
+		{input: "cudnn(gpu=0),cudnn(gpu=1)", want: "cudnn(gpu=0),cudnn(gpu=1)"},
+		{input: "a(backend=cuda,b(gpu=1))", want: "a(backend=cuda,b(gpu=1))"},
+		{input: `provider="a b",x='say "hi"'`, want: `provider="a b",x='say "hi"'`},
+		{input: "x=", errPos: 3},
+		{input: "gpu=1 max_batch=2", errPos: 7},
+		{input: "cudnn(gpu=0", errPos: 12},
+		{input: "cudnn(gpu=0 x)", errPos: 13},
+		{input: ",gpu=1", errPos: 1},
+		{input: `provider="abc`, errPos: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			l, err := Parse(tt.input)
+			if tt.errPos != 0 {
+				e, ok := err.(*Error)
+				if !ok {
+					t.Fatalf("Parse() = %v, %v, want an error at column %d", l, err, tt.errPos)
+				}
+				if e.Pos+1 != tt.errPos {
+					t.Errorf("Parse() error at column %d, want %d: %v", e.Pos+1, tt.errPos, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() = %v", err)
+			}
+			if got := l.String(); got != tt.want {
+				t.Errorf("Parse().String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr string
+	}{
+		{"gpu=1,max_batch=512", ""},
+		{"cudnn(gpu=0),cuda-fp16(gpu=1)", ""},
+		{"a(backend=cuda,gpu=0),b(backend=cudnn,gpu=1)", ""},
+		{"mode=check,freq=0.1,atol=1e-3", ""},
+		{"debug=1", `option "debug" is not allowed`},
+		{"backend=random", `backend "random" is not allowed`},
+		{"trivial", `backend "trivial" is not allowed`},
+		{"a(gpu=0)", `backend "a" is not allowed`},
+		{"cudnn(recordreplay(gpu=0))", `backend "recordreplay" is not allowed`},
+		{"a(backend=trivial)", `backend "trivial" is not allowed`},
+		{"mode=random", `check mode "random" is not allowed`},
+		{"gpu=(", "expected a value for gpu"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, err := Validate(tt.input)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Validate() = %v, want no error", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Validate() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckFlags(t *testing.T) {
+	tests := []struct {
+		args []string
+		ok   bool
+	}{
+		{nil, true},
+		{[]string{"--nncache=2000000", "--threads", "2"}, true},
+		{[]string{"--backend-threads=2"}, true},
+		{[]string{"--minibatch-size=256", "-t", "2"}, true},
+		{[]string{"--backend=random"}, false},
+		{[]string{"--backend", "random"}, false},
+		{[]string{"--Backend=random"}, false},
+		{[]string{"--backend-opts=gpu=1"}, false},
+		{[]string{"--player1.backend=trivial"}, false},
+		{[]string{"--player2.weights=net.pb.gz"}, false},
+		{[]string{"--weights", "net.pb.gz"}, false},
+		{[]string{"-b", "random"}, false},
+		{[]string{"-brandom"}, false},
+		{[]string{"-o=gpu=1"}, false},
+		{[]string{"-W", "net.pb.gz"}, false},
+	}
+	for _, tt := range tests {
+		err := CheckFlags(tt.args)
+		if (err == nil) != tt.ok {
+			t.Errorf("CheckFlags(%q) = %v, want ok %v", tt.args, err, tt.ok)
+		}
+	}
+}
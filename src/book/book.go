@@ -0,0 +1,218 @@
+// Package book prepares opening books for use by lc0.
+//
+// Books are PGN games or EPD positions, served as plain .pgn or .epd files
+// or compressed as .gz or .zip. lc0 is always given the uncompressed file.
+package book
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Tilps/chess"
+)
+
+// IsCompressed reports whether the book at path needs to be extracted.
+func IsCompressed(path string) bool {
+	return strings.HasSuffix(path, ".gz") || strings.HasSuffix(path, ".zip")
+}
+
+// Ext returns the extension of the uncompressed book at path, ".epd" for EPD
+// books and ".pgn" otherwise.
+func Ext(path string) string {
+	path = strings.TrimSuffix(strings.TrimSuffix(path, ".gz"), ".zip")
+	if strings.HasSuffix(strings.ToLower(path), ".epd") {
+		return ".epd"
+	}
+	return ".pgn"
+}
+
+// ExtractedPath returns the path of the uncompressed book for the book at
+// path.
+func ExtractedPath(path string) string {
+	path = strings.TrimSuffix(strings.TrimSuffix(path, ".gz"), ".zip")
+	if strings.ToLower(filepath.Ext(path)) != Ext(path) {
+		path += Ext(path)
+	}
+	return path
+}
+
+// Extract writes the book contained in the compressed book at path to
+// ExtractedPath(path). All files of a zip archive with the book's extension
+// are concatenated.
+func Extract(path string) (string, error) {
+	dst := ExtractedPath(path)
+	dir, _ := filepath.Split(dst)
+	out, err := ioutil.TempFile(dir, filepath.Base(dst)+"_tmp")
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(path, ".zip") {
+		err = extractZip(path, Ext(path), out)
+	} else {
+		err = extractGzip(path, out)
+	}
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dst)
+	}
+	// Ensure tmpfile is erased
+	os.Remove(out.Name())
+	if err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+func extractGzip(path string, out io.Writer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, reader)
+	return err
+}
+
+func extractZip(path string, ext string, out io.Writer) error {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	found := false
+	for _, f := range archive.File {
+		if f.FileInfo().IsDir() || !strings.HasSuffix(strings.ToLower(f.Name), ext) {
+			continue
+		}
+		reader, err := f.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+		// Keep games or positions of different files apart.
+		io.WriteString(out, "\n\n")
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("no %s file in zip archive", ext)
+	}
+	return nil
+}
+
+// CountOpenings parses every game or position in the book file at path and
+// returns how many there are. It fails if any opening does not parse or
+// there are none.
+func CountOpenings(path string) (int, error) {
+	if Ext(path) == ".epd" {
+		return countPositions(path)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	count := 0
+	var game strings.Builder
+	inMoves := false
+	flush := func() error {
+		if strings.TrimSpace(game.String()) == "" {
+			return nil
+		}
+		if _, err := chess.PGN(strings.NewReader(game.String())); err != nil {
+			return fmt.Errorf("opening %d: %v", count+1, err)
+		}
+		count++
+		game.Reset()
+		inMoves = false
+		return nil
+	}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+			if inMoves {
+				if err := flush(); err != nil {
+					return count, err
+				}
+			}
+			continue
+		case strings.HasPrefix(line, "["):
+			if inMoves {
+				if err := flush(); err != nil {
+					return count, err
+				}
+			}
+		default:
+			inMoves = true
+		}
+		game.WriteString(line)
+		game.WriteString("\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return count, err
+	}
+	if err := flush(); err != nil {
+		return count, err
+	}
+	if count == 0 {
+		return 0, errors.New("no openings found")
+	}
+	return count, nil
+}
+
+// countPositions checks that every non-empty line of the EPD file at path
+// starts with a valid position and returns how many there are.
+func countPositions(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	count := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		// EPD has no move counters, operations may follow the 4 fields.
+		if len(fields) < 4 {
+			return count, fmt.Errorf("position %d: too few fields", count+1)
+		}
+		fen := strings.Join(fields[:4], " ") + " 0 1"
+		if _, err := chess.FEN(fen); err != nil {
+			return count, fmt.Errorf("position %d: %v", count+1, err)
+		}
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return count, err
+	}
+	if count == 0 {
+		return 0, errors.New("no openings found")
+	}
+	return count, nil
+}
@@ -0,0 +1,151 @@
+package book
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractedPath(t *testing.T) {
+	tests := []struct {
+		path    string
+		wantExt string
+		want    string
+	}{
+		{"books/openings.pgn", ".pgn", "books/openings.pgn"},
+		{"books/openings.pgn.gz", ".pgn", "books/openings.pgn"},
+		{"books/openings.zip", ".pgn", "books/openings.pgn"},
+		{"books/openings.epd.zip", ".epd", "books/openings.epd"},
+		{"books/OPENINGS.EPD.gz", ".epd", "books/OPENINGS.EPD"},
+		{"books/openings", ".pgn", "books/openings.pgn"},
+	}
+	for _, tt := range tests {
+		if got := Ext(tt.path); got != tt.wantExt {
+			t.Errorf("Ext(%q) = %q, want %q", tt.path, got, tt.wantExt)
+		}
+		if got := ExtractedPath(tt.path); got != tt.want {
+			t.Errorf("ExtractedPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+const pgn = `[Event "one"]
+[Result "*"]
+
+1. e4 e5 2. Nf3 *
+
+[Event "two"]
+[Result "*"]
+
+1. d4 d5
+2. c4 *
+`
+
+const epd = `rnbqkbnr/pppppppp/8/8/4P3/8/PPPP1PPP/RNBQKBNR b KQkq e3 id "e4";
+
+rnbqkbnr/pppppppp/8/8/3P4/8/PPP1PPPP/RNBQKBNR b KQkq -
+`
+
+func TestCountOpenings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "book")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    int
+		wantErr string
+	}{
+		{name: "pgn", file: "a.pgn", content: pgn, want: 2},
+		{name: "moves only", file: "b.pgn", content: "1. e4 *\n\n1. d4 *\n", want: 2},
+		{name: "illegal move", file: "c.pgn", content: pgn + "\n[Event \"three\"]\n\n1. e5 *\n", want: 2, wantErr: "opening 3"},
+		{name: "empty pgn", file: "d.pgn", content: "\n\n", wantErr: "no openings"},
+		{name: "epd", file: "a.epd", content: epd, want: 2},
+		{name: "too few fields", file: "b.epd", content: epd + "8/8/8/8 w\n", want: 2, wantErr: "position 3: too few fields"},
+		{name: "bad position", file: "c.epd", content: "rnbqkbnr/pppppppp/8/8 w KQkq -\n", wantErr: "position 1"},
+		{name: "empty epd", file: "d.epd", content: "", wantErr: "no openings"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.file)
+			if err := ioutil.WriteFile(path, []byte(tt.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := CountOpenings(path)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("CountOpenings() error = %v, want %q", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("CountOpenings() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtract(t *testing.T) {
+	dir, err := ioutil.TempDir("", "book")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var gz bytes.Buffer
+	z := gzip.NewWriter(&gz)
+	z.Write([]byte(epd))
+	z.Close()
+	var zipped bytes.Buffer
+	w := zip.NewWriter(&zipped)
+	for name, content := range map[string]string{"book/a.epd": epd, "README.txt": "not a book"} {
+		f, _ := w.Create(name)
+		f.Write([]byte(content))
+	}
+	w.Close()
+
+	tests := []struct {
+		name    string
+		file    string
+		content []byte
+		want    int
+		wantErr string
+	}{
+		{name: "gzip", file: "a.epd.gz", content: gz.Bytes(), want: 2},
+		{name: "zip", file: "b.epd.zip", content: zipped.Bytes(), want: 2},
+		{name: "zip without the extension", file: "c.pgn.zip", content: zipped.Bytes(), wantErr: "no .pgn file"},
+		{name: "not gzip", file: "d.pgn.gz", content: []byte(pgn), wantErr: "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.file)
+			if err := ioutil.WriteFile(path, tt.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			extracted, err := Extract(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Extract() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				if _, err := os.Stat(ExtractedPath(path)); !os.IsNotExist(err) {
+					t.Errorf("a failed extraction left %s", ExtractedPath(path))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Extract() = %v", err)
+			}
+			if extracted != ExtractedPath(path) {
+				t.Errorf("Extract() = %s, want %s", extracted, ExtractedPath(path))
+			}
+			if got, err := CountOpenings(extracted); err != nil || got != tt.want {
+				t.Errorf("CountOpenings() of the extracted book = %d, %v, want %d", got, err, tt.want)
+			}
+		})
+	}
+}
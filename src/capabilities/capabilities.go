@@ -0,0 +1,155 @@
+// Package capabilities finds out what an lc0 binary supports from its
+// --help and --version output.
+//
+// The backends are read from the list of values lc0 accepts for --backend,
+// so backends added to lc0 later are found without changes here. Output in
+// an unexpected format falls back to looking for the backend names known
+// when this was written.
+package capabilities
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// Capabilities describes an lc0 binary.
+type Capabilities struct {
+	// Like v0.31.2, empty if unknown.
+	Version string
+	// The rest of the version line, the build date and for development
+	// builds the git revision.
+	Build string
+	// Backends doing the network computation, in the order lc0 lists them.
+	Backends []string
+	// Backends wrapping other backends, such as check and multiplexing.
+	Wrappers []string
+}
+
+// Backends that wrap or replace real ones, not to be picked for training.
+var wrappers = map[string]bool{
+	"check":        true,
+	"demux":        true,
+	"multiplexing": true,
+	"mux":          true,
+	"recordreplay": true,
+	"round-robin":  true,
+	"roundrobin":   true,
+	"random":       true,
+	"trivial":      true,
+}
+
+// Backends computing on the CPU.
+var cpuBackends = map[string]bool{
+	"blas":     true,
+	"eigen":    true,
+	"onnx-cpu": true,
+}
+
+// Backend names searched for if the --backend values cannot be parsed.
+var known = []string{"cudnn-auto", "cuda-auto", "cudnn", "cudnn-fp16", "cuda", "cuda-fp16",
+	"onnx-cuda", "onnx-trt", "onnx-dml", "onnx-rocm", "onnx-cpu", "dx12", "metal", "sycl",
+	"opencl", "blas", "eigen", "check", "multiplexing", "demux", "recordreplay", "round-robin"}
+
+var (
+	valuesRegex  = regexp.MustCompile(`VALUES:\s*([^\]\s]+)`)
+	versionRegex = regexp.MustCompile(`(v\d+\.\d+\.\d+\S*)\s*(.*)`)
+)
+
+// Probe runs lc0 to find out its capabilities.
+func Probe(lc0 string) (*Capabilities, error) {
+	help, err := exec.Command(lc0, "--help").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%s --help: %v", lc0, err)
+	}
+	// Not all versions know --version, the help banner has it too.
+	version, _ := exec.Command(lc0, "--version").CombinedOutput()
+	return Parse(string(help), string(version)), nil
+}
+
+// Parse reads capabilities from the output of lc0 --help and --version.
+func Parse(help string, version string) *Capabilities {
+	c := &Capabilities{}
+	for _, out := range []string{version, help} {
+		if m := versionRegex.FindStringSubmatch(out); m != nil {
+			c.Version = m[1]
+			c.Build = strings.TrimSpace(m[2])
+			break
+		}
+	}
+	var names []string
+	lines := strings.Split(help, "\n")
+	for i, line := range lines {
+		if !strings.Contains(line, "--backend=") && !strings.Contains(line, "--backend ") {
+			continue
+		}
+		// The values follow the flag within a few lines.
+		for j := i; j < len(lines) && j < i+4; j++ {
+			if m := valuesRegex.FindStringSubmatch(lines[j]); m != nil {
+				names = strings.Split(m[1], ",")
+				break
+			}
+		}
+		if names != nil {
+			break
+		}
+	}
+	if names == nil {
+		for _, name := range known {
+			if strings.Contains(help, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+		case wrappers[name]:
+			c.Wrappers = append(c.Wrappers, name)
+		default:
+			c.Backends = append(c.Backends, name)
+		}
+	}
+	return c
+}
+
+// Has reports whether lc0 supports backend.
+func (c *Capabilities) Has(backend string) bool {
+	for _, list := range [][]string{c.Backends, c.Wrappers} {
+		for _, b := range list {
+			if b == backend {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Select returns the backends of priority lc0 supports, in that order.
+func (c *Capabilities) Select(priority []string) []string {
+	var selected []string
+	for _, b := range priority {
+		if c.Has(b) && !wrappers[b] {
+			selected = append(selected, b)
+		}
+	}
+	return selected
+}
+
+func (c *Capabilities) String() string {
+	version := c.Version
+	if version == "" {
+		version = "unknown version"
+	}
+	if c.Build != "" {
+		version += " " + c.Build
+	}
+	return fmt.Sprintf("lc0 %s, backends: %s", version, strings.Join(c.Backends, ", "))
+}
+
+// IsCPU reports whether backend computes on the CPU.
+func IsCPU(backend string) bool {
+	return cpuBackends[backend]
+}
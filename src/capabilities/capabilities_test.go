@@ -0,0 +1,108 @@
+package capabilities
+
+import (
+	"reflect"
+	"testing"
+)
+
+const helpCuda = `       _
+|   _ | |
+|_ |_ |_| v0.31.2 built Oct 20 2024
+Usage: lc0 [<mode>] [flags...]
+
+  -b,  --backend=cuda-auto
+         Neural network computational backend to use.
+         [UCI: Backend  DEFAULT: cuda-auto  VALUES: cuda-auto,cuda,cuda-fp16,blas,eigen,trivial,random,check,recordreplay,demux,multiplexing,round-robin]
+`
+
+const helpOld = `|_ |_ |_| v0.28.0 built Aug 1 2021
+  --backend=<choice>
+         Neural network computational backend to use.
+         Backends: cudnn, cudnn-fp16, blas, check, multiplexing
+`
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		help     string
+		version  string
+		want     Capabilities
+		wantCuda bool
+	}{
+		{
+			name:    "values list",
+			help:    helpCuda,
+			version: "Lc0 v0.31.2 built Oct 20 2024",
+			want: Capabilities{
+				Version:  "v0.31.2",
+				Build:    "built Oct 20 2024",
+				Backends: []string{"cuda-auto", "cuda", "cuda-fp16", "blas", "eigen"},
+				Wrappers: []string{"trivial", "random", "check", "recordreplay", "demux", "multiplexing", "round-robin"},
+			},
+			wantCuda: true,
+		},
+		{
+			name: "version from banner",
+			help: helpCuda,
+			want: Capabilities{
+				Version:  "v0.31.2",
+				Build:    "built Oct 20 2024",
+				Backends: []string{"cuda-auto", "cuda", "cuda-fp16", "blas", "eigen"},
+				Wrappers: []string{"trivial", "random", "check", "recordreplay", "demux", "multiplexing", "round-robin"},
+			},
+			wantCuda: true,
+		},
+		{
+			name: "known names",
+			help: helpOld,
+			want: Capabilities{
+				Version:  "v0.28.0",
+				Build:    "built Aug 1 2021",
+				Backends: []string{"cudnn", "cudnn-fp16", "blas"},
+				Wrappers: []string{"check", "multiplexing"},
+			},
+		},
+		{
+			name: "development build",
+			help: "|_ |_ |_| v0.32.0-dev+git.abc123 built Jan 1 2026\n  --backend=eigen\n  [VALUES: eigen]\n",
+			want: Capabilities{
+				Version:  "v0.32.0-dev+git.abc123",
+				Build:    "built Jan 1 2026",
+				Backends: []string{"eigen"},
+			},
+		},
+		{
+			name: "unknown output",
+			help: "something else",
+			want: Capabilities{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Parse(tt.help, tt.version)
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", *got, tt.want)
+			}
+			if got.Has("cuda") != tt.wantCuda {
+				t.Errorf("Has(cuda) = %v, want %v", got.Has("cuda"), tt.wantCuda)
+			}
+		})
+	}
+}
+
+func TestSelect(t *testing.T) {
+	c := Parse(helpCuda, "")
+	tests := []struct {
+		priority []string
+		want     []string
+	}{
+		{[]string{"cudnn", "cuda-fp16", "cuda-auto"}, []string{"cuda-fp16", "cuda-auto"}},
+		{[]string{"check", "eigen"}, []string{"eigen"}},
+		{[]string{"dx12"}, nil},
+	}
+	for _, tt := range tests {
+		if got := c.Select(tt.priority); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Select(%v) = %v, want %v", tt.priority, got, tt.want)
+		}
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
-	"log"
 	"mime/multipart"
 	"net/http"
 	"net/url"
@@ -14,6 +13,15 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+
+	"github.com/LeelaChessZero/lczero-client/src/hooks"
+	"github.com/LeelaChessZero/lczero-client/src/logging"
+	"github.com/LeelaChessZero/lczero-client/src/webhook"
+)
+
+var (
+	serverLog = logging.New("scheduler")
+	cacheLog  = logging.New("cache")
 )
 
 func postParams(httpClient *http.Client, uri string, data map[string]string, target interface{}) error {
@@ -35,10 +43,12 @@ func postParams(httpClient *http.Client, uri string, data map[string]string, tar
 		err = json.Unmarshal(b, target)
 		if err != nil {
 			if strings.Contains(string(b), " upgrade ") {
-				log.Printf("The client version you are using is not accepted by the server")
-				os.Exit(5)
+				serverLog.Errorf("The client version you are using is not accepted by the server")
+				webhook.SendAndWait(webhook.UpgradeRequired, "The server no longer accepts this client version, the client exited", nil)
+				hooks.RunAndWait(hooks.UpgradeRequired, map[string]interface{}{"component": "client"})
+				hooks.Exit(5, "upgrade required")
 			}
-			log.Printf("Bad JSON from %s -- %s\n", uri, string(b))
+			serverLog.Warnf("Bad JSON from %s -- %s", uri, string(b))
 		}
 	}
 	return err
@@ -76,6 +86,15 @@ func BuildUploadRequest(uri string, params map[string]string, paramName, path st
 	return req, err
 }
 
+// A file the server wants available to lc0. Its path is substituted for
+// Placeholder in the params, which defaults to "{artifact:<Name>}".
+type Artifact struct {
+	Name        string
+	Url         string
+	Sha         string
+	Placeholder string
+}
+
 type NextGameResponse struct {
 	Type         string
 	TrainingId   uint
@@ -88,6 +107,11 @@ type NextGameResponse struct {
 	KeepTime     string
 	BookUrl      string
 	BookSha      string
+	Artifacts    []Artifact
+	// The oldest lc0 the server accepts games from and the one it
+	// recommends, empty if it does not say.
+	MinLc0Version         string
+	RecommendedLc0Version string
 }
 
 func NextGame(httpClient *http.Client, hostname string, params map[string]string) (NextGameResponse, error) {
@@ -109,29 +133,63 @@ func UploadMatchResult(httpClient *http.Client, hostname string, match_game_id u
 }
 
 func DownloadNetwork(httpClient *http.Client, uriPrefix string, networkPath string, sha string) error {
-	uri := uriPrefix + sha
-	r, err := httpClient.Get(uri)
+	return DownloadFile(httpClient, uriPrefix+sha, networkPath)
+}
+
+// Downloads uri to path. The data is written to path+"_tmp" first, and an
+// interrupted download is resumed from there by the next call.
+func DownloadFile(httpClient *http.Client, uri string, path string) error {
+	tmpPath := path + "_tmp"
+	var offset int64
+	if fi, err := os.Stat(tmpPath); err == nil {
+		offset = fi.Size()
+	}
+
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	}
+	r, err := httpClient.Do(req)
 	if err != nil {
 		return err
 	}
+	defer r.Body.Close()
 
-	if r.StatusCode >= 400 {
-		return errors.New("Network server gave error status.")
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case r.StatusCode == http.StatusPartialContent:
+		cacheLog.Infof("Resuming download of %s at %d bytes", filepath.Base(path), offset)
+		flags |= os.O_APPEND
+	case r.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is no good, start over next time.
+		os.Remove(tmpPath)
+		return errors.New("Server rejected resuming the download.")
+	case r.StatusCode >= 400:
+		return errors.New("Download server gave error status: " + r.Status)
+	default:
+		flags |= os.O_TRUNC
 	}
 
-	dir, _ := filepath.Split(networkPath)
-	out, err := ioutil.TempFile(dir, sha+"_tmp")
+	out, err := os.OpenFile(tmpPath, flags, 0644)
 	if err != nil {
 		return err
 	}
-
 	_, err = io.Copy(out, r.Body)
-	r.Body.Close()
-	out.Close()
-	if err == nil {
-		err = os.Rename(out.Name(), networkPath)
+	closeErr := out.Close()
+	if err != nil {
+		// Keep the partial file to resume from.
+		return err
+	}
+	if closeErr != nil {
+		os.Remove(tmpPath)
+		return closeErr
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		os.Remove(tmpPath)
 	}
-	// Ensure tmpfile is erased
-	os.Remove(out.Name())
 	return err
 }
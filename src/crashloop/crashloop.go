@@ -0,0 +1,131 @@
+// Package crashloop classifies why lc0 exited and spaces out restarts with
+// exponential backoff.
+package crashloop
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cause is the likely reason lc0 exited.
+type Cause string
+
+const (
+	UnknownFlag    Cause = "unknown-flag"
+	CudaError      Cause = "cuda-error"
+	OutOfMemory    Cause = "out-of-memory"
+	CheckFailed    Cause = "check-failed"
+	MissingLibrary Cause = "missing-library"
+	Stalled        Cause = "stalled"
+	Unknown        Cause = "unknown"
+)
+
+// Output fragments identifying each cause, checked in order. Matching is
+// case insensitive.
+var patterns = []struct {
+	cause     Cause
+	fragments []string
+}{
+	{UnknownFlag, []string{"unknown command line flag", "unknown option"}},
+	{CheckFailed, []string{"*** error check failed"}},
+	{OutOfMemory, []string{"out of memory", "bad_alloc", "cudaerrormemoryallocation", "failed to allocate"}},
+	{MissingLibrary, []string{"error while loading shared libraries", "cannot open shared object file",
+		".dll was not found", "library not loaded"}},
+	{CudaError, []string{"cuda error", "cudnn error", "cublas error", "cuda-capable device",
+		"cuda driver version is insufficient", "gpu has fallen off the bus"}},
+}
+
+// Hints tells the user what to try for each cause.
+var Hints = map[Cause]string{
+	UnknownFlag:    "lc0 is probably too old for this client, update it",
+	CudaError:      "check the GPU driver and that the GPU works",
+	OutOfMemory:    "try a lower --parallelism or close other programs using the GPU",
+	CheckFailed:    "the backend computes wrong results, try updating the GPU driver",
+	MissingLibrary: "install the libraries lc0 needs, or use an lc0 build matching this system",
+	Stalled:        "check that the GPU works and is not shared with other heavy work, or raise --stall-timeout",
+	Unknown:        "see the lc0 output above",
+}
+
+// Classify returns the likely cause of lc0 exiting from its last output
+// lines and exit error.
+func Classify(lines []string, exitErr error) Cause {
+	for _, p := range patterns {
+		for _, line := range lines {
+			lower := strings.ToLower(line)
+			for _, f := range p.fragments {
+				if strings.Contains(lower, f) {
+					return p.cause
+				}
+			}
+		}
+	}
+	// Killed without being asked to, most likely by the kernel's OOM killer.
+	if exitErr != nil && strings.Contains(exitErr.Error(), "signal: killed") {
+		return OutOfMemory
+	}
+	return Unknown
+}
+
+// Summarize describes a series of causes as counts, most common first.
+func Summarize(causes []Cause) string {
+	counts := map[Cause]int{}
+	for _, c := range causes {
+		counts[c]++
+	}
+	keys := make([]Cause, 0, len(counts))
+	for c := range counts {
+		keys = append(keys, c)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	var parts []string
+	for _, c := range keys {
+		parts = append(parts, fmt.Sprintf("%d %s", counts[c], c))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Not seeded by default before Go 1.20, and all clients would jitter alike.
+// A rand.Rand is not safe for concurrent use, the workers of all GPUs back
+// off at once.
+var (
+	randomMutex sync.Mutex
+	random      = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Backoff computes exponentially growing delays between Min and Max, with
+// 10% of random jitter either way so that clients do not retry in lockstep.
+type Backoff struct {
+	Min      time.Duration
+	Max      time.Duration
+	failures int
+}
+
+// Next returns the delay before the next attempt.
+func (b *Backoff) Next() time.Duration {
+	d := b.Min
+	for i := 0; i < b.failures && d < b.Max; i++ {
+		d *= 2
+	}
+	if d > b.Max {
+		d = b.Max
+	}
+	b.failures++
+	randomMutex.Lock()
+	jitter := time.Duration(random.Int63n(int64(d)/5 + 1))
+	randomMutex.Unlock()
+	return d - d/10 + jitter
+}
+
+// Reset starts over from Min after a success.
+func (b *Backoff) Reset() {
+	b.failures = 0
+}
@@ -0,0 +1,84 @@
+package crashloop
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		err   error
+		want  Cause
+	}{
+		{"unknown flag", []string{"Unknown command line flag: --foo."}, nil, UnknownFlag},
+		{"unknown option", []string{"Unknown option: --bar"}, nil, UnknownFlag},
+		{"check failed", []string{"*** ERROR check failed for a position"}, nil, CheckFailed},
+		{"cuda out of memory", []string{"CUDA error: out of memory (cudaErrorMemoryAllocation)"}, nil, OutOfMemory},
+		{"bad alloc", []string{"terminate called after throwing an instance of 'std::bad_alloc'"}, nil, OutOfMemory},
+		{"missing library", []string{"./lc0: error while loading shared libraries: libcudnn.so.8: cannot open shared object file"}, nil, MissingLibrary},
+		{"missing dll", []string{"The code execution cannot proceed because cublas64_11.dll was not found."}, nil, MissingLibrary},
+		{"cuda error", []string{"GPU: NVIDIA", "CUDA error: invalid device ordinal"}, nil, CudaError},
+		{"old driver", []string{"CUDA driver version is insufficient for CUDA runtime version"}, nil, CudaError},
+		{"killed", []string{"info depth 1"}, errors.New("signal: killed"), OutOfMemory},
+		{"exit status", []string{"info depth 1"}, errors.New("exit status 1"), Unknown},
+		{"no output", nil, nil, Unknown},
+		{"first pattern wins", []string{"CUDA error: out of memory", "unknown option"}, nil, UnknownFlag},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Classify(tt.lines, tt.err); got != tt.want {
+				t.Errorf("Classify(%q, %v) = %s, want %s", tt.lines, tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	tests := []struct {
+		causes []Cause
+		want   string
+	}{
+		{nil, ""},
+		{[]Cause{Unknown}, "1 unknown"},
+		{[]Cause{CudaError, Unknown, CudaError}, "2 cuda-error, 1 unknown"},
+		{[]Cause{Unknown, CudaError}, "1 cuda-error, 1 unknown"},
+	}
+	for _, tt := range tests {
+		if got := Summarize(tt.causes); got != tt.want {
+			t.Errorf("Summarize(%v) = %q, want %q", tt.causes, got, tt.want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{Min: time.Second, Max: 8 * time.Second}
+	for _, want := range []time.Duration{1, 2, 4, 8, 8, 1} {
+		if want == 1 && b.failures > 0 {
+			b.Reset()
+		}
+		want *= time.Second
+		got := b.Next()
+		if got < want-want/10 || got > want+want/10 {
+			t.Errorf("Next() = %v, want %v ± 10%%", got, want)
+		}
+	}
+}
+
+func TestBackoffConcurrently(t *testing.T) {
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func() {
+			b := Backoff{Min: time.Second, Max: time.Minute}
+			for j := 0; j < 100; j++ {
+				b.Next()
+			}
+			done <- true
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+}
@@ -0,0 +1,102 @@
+// Package health serves liveness and readiness endpoints for container
+// orchestrators, and queries them for the healthcheck subcommand.
+//
+// The liveness endpoint answers as long as the process runs. The readiness
+// endpoint runs the registered checks and fails if any of them does.
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Check returns an error describing why the client is not ready.
+type Check func() error
+
+var (
+	mutex  sync.Mutex
+	checks = map[string]Check{}
+)
+
+// Register adds a readiness check.
+func Register(name string, check Check) {
+	mutex.Lock()
+	checks[name] = check
+	mutex.Unlock()
+}
+
+// Result is the outcome of the readiness checks, keyed by check name.
+type Result struct {
+	Ready  bool
+	Checks map[string]string
+}
+
+// Run runs all readiness checks.
+func Run() Result {
+	mutex.Lock()
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	cs := make([]Check, 0, len(checks))
+	sort.Strings(names)
+	for _, name := range names {
+		cs = append(cs, checks[name])
+	}
+	mutex.Unlock()
+	r := Result{Ready: true, Checks: map[string]string{}}
+	for i, check := range cs {
+		if err := check(); err != nil {
+			r.Ready = false
+			r.Checks[names[i]] = err.Error()
+		} else {
+			r.Checks[names[i]] = "ok"
+		}
+	}
+	return r
+}
+
+// LiveHandler serves the liveness endpoint.
+func LiveHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, "ok\n")
+	})
+}
+
+// ReadyHandler serves the readiness endpoint, with status 503 if a check
+// fails.
+func ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := Run()
+		w.Header().Set("Content-Type", "application/json")
+		if !result.Ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+	})
+}
+
+// Query fetches url and returns an error unless it answers with status 200.
+func Query(url string, timeout time.Duration) error {
+	httpClient := &http.Client{Timeout: timeout}
+	resp, err := httpClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+// Package hooks runs user commands on client lifecycle events.
+//
+// Each command is run through the shell with the event data as a JSON object
+// on stdin, and also in LC0_* environment variables: LC0_EVENT holds the event
+// name and every data field is LC0_ followed by its upper cased key.
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LeelaChessZero/lczero-client/src/logging"
+)
+
+// Event is a client lifecycle event.
+type Event string
+
+const (
+	// The training network or match networks changed.
+	NetworkChanged Event = "network-changed"
+	// A training game or match result was uploaded.
+	GameUploaded Event = "game-uploaded"
+	// Several games in a row failed to upload.
+	UploadFailed Event = "upload-failed"
+	// lc0 exited without being asked to.
+	Lc0Crashed Event = "lc0-crashed"
+	// The server no longer accepts this client or lc0 version.
+	UpgradeRequired Event = "upgrade-required"
+	// The client is about to exit.
+	ClientExiting Event = "client-exiting"
+)
+
+// Events lists all events, for help texts and validation.
+var Events = []Event{NetworkChanged, GameUploaded, UploadFailed, Lc0Crashed, UpgradeRequired, ClientExiting}
+
+var hooksLog = logging.New("hooks")
+
+var (
+	mutex    sync.Mutex
+	commands = map[Event][]string{}
+	timeout  = 30 * time.Second
+	exitOnce sync.Once
+)
+
+// Add registers a hook given as "event=command".
+func Add(spec string) error {
+	idx := strings.Index(spec, "=")
+	if idx <= 0 || idx == len(spec)-1 {
+		return fmt.Errorf("hook %q is not of the form event=command", spec)
+	}
+	event := Event(spec[:idx])
+	known := false
+	for _, e := range Events {
+		if e == event {
+			known = true
+		}
+	}
+	if !known {
+		var names []string
+		for _, e := range Events {
+			names = append(names, string(e))
+		}
+		return fmt.Errorf("unknown hook event %q, use one of %s", event, strings.Join(names, ", "))
+	}
+	mutex.Lock()
+	commands[event] = append(commands[event], spec[idx+1:])
+	mutex.Unlock()
+	return nil
+}
+
+// Has reports whether any hooks are registered for event.
+func Has(event Event) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return len(commands[event]) > 0
+}
+
+// SetTimeout sets how long a hook may run before it is killed.
+func SetTimeout(d time.Duration) {
+	mutex.Lock()
+	timeout = d
+	mutex.Unlock()
+}
+
+func envName(key string) string {
+	return "LC0_" + strings.ToUpper(strings.Replace(key, "-", "_", -1))
+}
+
+func run(command string, event Event, input []byte, env []string, d time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Env = append(os.Environ(), env...)
+	output, err := cmd.CombinedOutput()
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if line != "" {
+			hooksLog.Infof("%s: %s", event, line)
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		hooksLog.Warnf("%s hook %q timed out after %v", event, command, d)
+	} else if err != nil {
+		hooksLog.Warnf("%s hook %q failed: %v", event, command, err)
+	}
+}
+
+func fire(event Event, data map[string]interface{}, wait bool) {
+	mutex.Lock()
+	cmds := append([]string(nil), commands[event]...)
+	d := timeout
+	mutex.Unlock()
+	if len(cmds) == 0 {
+		return
+	}
+	payload := map[string]interface{}{}
+	for key, value := range data {
+		payload[key] = value
+	}
+	payload["event"] = string(event)
+	payload["time"] = time.Now().Format(time.RFC3339)
+	input, err := json.Marshal(payload)
+	if err != nil {
+		hooksLog.Errorf("Cannot encode %s event: %v", event, err)
+		return
+	}
+	keys := make([]string, 0, len(payload))
+	for key := range payload {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var env []string
+	for _, key := range keys {
+		env = append(env, fmt.Sprintf("%s=%v", envName(key), payload[key]))
+	}
+	wg := &sync.WaitGroup{}
+	for _, command := range cmds {
+		hooksLog.Debugf("Running %s hook: %s", event, command)
+		wg.Add(1)
+		go func(command string) {
+			defer wg.Done()
+			run(command, event, append([]byte(nil), input...), env, d)
+		}(command)
+	}
+	if wait {
+		wg.Wait()
+	}
+}
+
+// Run starts the hooks for event in the background.
+func Run(event Event, data map[string]interface{}) {
+	fire(event, data, false)
+}
+
+// RunAndWait runs the hooks for event and waits for them to finish.
+func RunAndWait(event Event, data map[string]interface{}) {
+	fire(event, data, true)
+}
+
+// Exit runs the client exiting hooks and exits with code.
+func Exit(code int, reason string) {
+	NotifyExit(code, reason)
+	os.Exit(code)
+}
+
+// NotifyExit runs the client exiting hooks without exiting, for code paths
+// that exit by themselves. Only the first call runs them.
+func NotifyExit(code int, reason string) {
+	exitOnce.Do(func() {
+		RunAndWait(ClientExiting, map[string]interface{}{"exit_code": code, "reason": reason})
+	})
+}
@@ -0,0 +1,805 @@
+// Package lc0manager installs lc0 versions side by side and switches between
+// them, doing what client.sh does with git, meson and restarts.
+//
+// Releases come from a directory or url holding archives named like
+// lc0-v0.31.2-linux.tar.gz or lc0-v0.31.2-windows-gpu-nvidia-cuda.zip, and a
+// SHA256SUMS file listing them in the sha256sum format. The part after the
+// version is the variant, only archives of the configured variant are used.
+// Without a fitting release lc0 can be built from a source tree with meson
+// and ninja.
+//
+// Each version is unpacked in its own directory under versions, and
+// current.json names the one in use. A version is switched to only after it
+// passed the capability probe, by replacing current.json, so a broken
+// release leaves the previous version in use. Clients sharing the directory
+// take turns through a lock file.
+package lc0manager
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/LeelaChessZero/lczero-client/src/capabilities"
+	"github.com/LeelaChessZero/lczero-client/src/client"
+	"github.com/LeelaChessZero/lczero-client/src/lc0version"
+	"github.com/LeelaChessZero/lczero-client/src/logging"
+	"github.com/gofrs/flock"
+)
+
+var managerLog = logging.New("lc0")
+
+// Config says where lc0 versions come from.
+type Config struct {
+	// Directory or http(s) url with the release archives and SHA256SUMS,
+	// empty to not use releases.
+	Releases string
+	// Which archives to use, e.g. linux or windows-gpu-nvidia-cuda.
+	Variant string
+	// lc0 source tree to build if no release fits, empty to not build.
+	Source string
+	// Installed versions to keep besides the current and previous ones,
+	// 0 to keep all.
+	Keep int
+}
+
+// Release is a release archive listed in SHA256SUMS.
+type Release struct {
+	Name    string
+	Version string
+	Sha     string
+}
+
+// Installed describes an installed version.
+type Installed struct {
+	Version  string
+	Current  bool
+	Previous bool
+	Rejected bool
+	Pinned   bool
+}
+
+// state is kept in current.json.
+type state struct {
+	Current  string
+	Previous string
+	// Versions the server refused, not to be used again.
+	Rejected []string
+	// Releases that failed the probe when installed, not to be installed
+	// again.
+	Broken []string
+	// The version rolled back to, kept until an explicit update.
+	Pinned string
+}
+
+func contains(list []string, version string) bool {
+	for _, v := range list {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *state) rejected(version string) bool {
+	return contains(s.Rejected, version)
+}
+
+// skipped reports whether version must not be picked.
+func (s *state) skipped(version string) bool {
+	return s.rejected(version) || contains(s.Broken, version)
+}
+
+// Manager keeps lc0 versions in a directory.
+type Manager struct {
+	dir        string
+	config     Config
+	httpClient *http.Client
+}
+
+const stateName = "current.json"
+
+var (
+	releaseRegex = regexp.MustCompile(`^lc0-(v\d+\.\d+\.\d+(?:-rc\d+)?)-(.+)\.(zip|tar\.gz|tgz)$`)
+	shaRegex     = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// Open returns the manager of dir, creating the directory if needed.
+func Open(dir string, httpClient *http.Client, config Config) (*Manager, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "versions"), os.ModePerm); err != nil {
+		return nil, err
+	}
+	return &Manager{dir: dir, config: config, httpClient: httpClient}, nil
+}
+
+func exeName() string {
+	if runtime.GOOS == "windows" {
+		return "lc0.exe"
+	}
+	return "lc0"
+}
+
+func isURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+func (m *Manager) lock() (func(), error) {
+	lock := flock.New(filepath.Join(m.dir, "lock"))
+	if err := lock.Lock(); err != nil {
+		return nil, err
+	}
+	return func() { lock.Unlock() }, nil
+}
+
+func (m *Manager) readState() (*state, error) {
+	s := &state{}
+	b, err := ioutil.ReadFile(filepath.Join(m.dir, stateName))
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, json.Unmarshal(b, s)
+}
+
+// writeState replaces current.json in one rename, so readers see either
+// the old or the new version.
+func (m *Manager) writeState(s *state) error {
+	b, err := json.MarshalIndent(s, "", " ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(m.dir, stateName)
+	if err := ioutil.WriteFile(path+"_tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+"_tmp", path)
+}
+
+func (m *Manager) versionDir(version string) string {
+	return filepath.Join(m.dir, "versions", version)
+}
+
+// exe finds the lc0 binary of an installed version, which archives may keep
+// in a subdirectory.
+func (m *Manager) exe(version string) (string, error) {
+	found := ""
+	err := filepath.Walk(m.versionDir(version), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if found == "" && !fi.IsDir() && fi.Name() == exeName() {
+			found = path
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if found == "" {
+		return "", fmt.Errorf("lc0 %s has no %s", version, exeName())
+	}
+	return filepath.Abs(found)
+}
+
+// check runs the capability probe on an installed version.
+func (m *Manager) check(version string) error {
+	exe, err := m.exe(version)
+	if err != nil {
+		return err
+	}
+	caps, err := capabilities.Probe(exe)
+	if err != nil {
+		return err
+	}
+	if caps.Version == "" {
+		return errors.New("it does not report its version")
+	}
+	if len(caps.Backends) == 0 {
+		return errors.New("it has no backends")
+	}
+	return nil
+}
+
+// switchTo makes version the current one if it passes the probe.
+func (m *Manager) switchTo(s *state, version string) error {
+	if err := m.check(version); err != nil {
+		return fmt.Errorf("lc0 %s failed the probe: %v", version, err)
+	}
+	if s.Current == version {
+		return nil
+	}
+	current, previous, pinned := s.Current, s.Previous, s.Pinned
+	s.Previous, s.Current = s.Current, version
+	if version != s.Pinned {
+		s.Pinned = ""
+	}
+	if err := m.writeState(s); err != nil {
+		s.Current, s.Previous, s.Pinned = current, previous, pinned
+		return err
+	}
+	managerLog.Infof("Switched to lc0 %s", version)
+	return nil
+}
+
+// ParseSums reads the releases of variant from a SHA256SUMS file, skipping
+// other files.
+func ParseSums(r io.Reader, variant string) ([]Release, error) {
+	var releases []Release
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !shaRegex.MatchString(strings.ToLower(fields[0])) {
+			return nil, fmt.Errorf("malformed checksum line %q", line)
+		}
+		// sha256sum marks binary mode files with a '*'.
+		name := strings.TrimPrefix(fields[1], "*")
+		m := releaseRegex.FindStringSubmatch(name)
+		if m == nil || m[2] != variant {
+			continue
+		}
+		releases = append(releases, Release{Name: name, Version: m[1], Sha: strings.ToLower(fields[0])})
+	}
+	return releases, scanner.Err()
+}
+
+func (m *Manager) open(name string) (io.ReadCloser, error) {
+	location := m.config.Releases
+	if !isURL(location) {
+		return os.Open(filepath.Join(location, name))
+	}
+	resp, err := m.httpClient.Get(strings.TrimSuffix(location, "/") + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("release server gave error status: %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// Available returns the releases of the configured variant, newest first.
+func (m *Manager) Available() ([]Release, error) {
+	r, err := m.open("SHA256SUMS")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	releases, err := ParseSums(r, m.config.Variant)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(releases, func(i, j int) bool {
+		return compare(releases[i].Version, releases[j].Version) > 0
+	})
+	return releases, nil
+}
+
+// compare compares versions, unparsable ones as the oldest.
+func compare(a string, b string) int {
+	va, errA := lc0version.Parse(a)
+	vb, errB := lc0version.Parse(b)
+	switch {
+	case errA != nil && errB != nil:
+		return strings.Compare(a, b)
+	case errA != nil:
+		return -1
+	case errB != nil:
+		return 1
+	}
+	return va.Compare(vb)
+}
+
+// pick returns the release to run, like client.sh picks tags: the newest
+// release the server did not refuse, or if it refused one as new, the newest
+// release candidate after that. Releases older than minimum are never picked,
+// and a release candidate is if only that is new enough.
+func pick(releases []Release, s *state, minimum string) *Release {
+	newestRejected := ""
+	for _, r := range s.Rejected {
+		if newestRejected == "" || compare(r, newestRejected) > 0 {
+			newestRejected = r
+		}
+	}
+	var candidate *Release
+	for i := range releases {
+		r := &releases[i]
+		if s.skipped(r.Version) || (minimum != "" && compare(r.Version, minimum) < 0) {
+			continue
+		}
+		isRC := lc0version.Prerelease(r.Version) != ""
+		if !isRC && (newestRejected == "" || compare(r.Version, newestRejected) > 0) {
+			return r
+		}
+		if isRC && candidate == nil && newestRejected != "" && compare(r.Version, newestRejected) > 0 {
+			candidate = r
+		}
+	}
+	if candidate != nil {
+		return candidate
+	}
+	// Nothing newer than what the server refused, keep to the releases.
+	for i := range releases {
+		r := &releases[i]
+		if !s.skipped(r.Version) && lc0version.Prerelease(r.Version) == "" && (minimum == "" || compare(r.Version, minimum) >= 0) {
+			return r
+		}
+	}
+	if minimum != "" {
+		for i := range releases {
+			r := &releases[i]
+			if !s.skipped(r.Version) && compare(r.Version, minimum) >= 0 {
+				return r
+			}
+		}
+	}
+	return nil
+}
+
+func fileSha(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sum.Sum(nil)), nil
+}
+
+// fetch gets the archive of r into the downloads directory and verifies its
+// checksum.
+func (m *Manager) fetch(r *Release) (string, error) {
+	dir := filepath.Join(m.dir, "downloads")
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, r.Name)
+	if sha, err := fileSha(path); err == nil && sha == r.Sha {
+		return path, nil
+	}
+	var err error
+	if isURL(m.config.Releases) {
+		err = client.DownloadFile(m.httpClient, strings.TrimSuffix(m.config.Releases, "/")+"/"+r.Name, path)
+	} else {
+		err = copyFile(filepath.Join(m.config.Releases, r.Name), path)
+	}
+	if err != nil {
+		return "", err
+	}
+	sha, err := fileSha(path)
+	if err != nil {
+		return "", err
+	}
+	if sha != r.Sha {
+		os.Remove(path)
+		return "", fmt.Errorf("checksum mismatch for %s", r.Name)
+	}
+	return path, nil
+}
+
+func copyFile(from string, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(to + "_tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(to + "_tmp")
+		return err
+	}
+	return os.Rename(to+"_tmp", to)
+}
+
+// target returns where an archive entry goes, refusing entries that would
+// end up outside dir.
+func target(dir string, name string) (string, error) {
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if !strings.HasPrefix(path, filepath.Clean(dir)+string(os.PathSeparator)) {
+		return "", fmt.Errorf("archive entry %s is outside the archive", name)
+	}
+	return path, nil
+}
+
+func writeEntry(path string, mode os.FileMode, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	if filepath.Base(path) == exeName() {
+		mode |= 0755
+	}
+	out, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode.Perm()|0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func extractZip(archive string, dir string) error {
+	z, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer z.Close()
+	for _, f := range z.File {
+		path, err := target(dir, f.Name)
+		if err != nil {
+			return err
+		}
+		if f.FileInfo().IsDir() {
+			if err := os.MkdirAll(path, os.ModePerm); err != nil {
+				return err
+			}
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return err
+		}
+		err = writeEntry(path, f.Mode(), r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func extractTar(archive string, dir string) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	z, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	t := tar.NewReader(z)
+	for {
+		h, err := t.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		path, err := target(dir, h.Name)
+		if err != nil {
+			return err
+		}
+		switch h.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, os.ModePerm); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeEntry(path, os.FileMode(h.Mode), t); err != nil {
+				return err
+			}
+		}
+		// Links and the like are not needed to run lc0.
+	}
+}
+
+// place moves a fully unpacked version from tmp to its directory, so that a
+// version directory is never half written.
+func (m *Manager) place(tmp string, version string) error {
+	dest := m.versionDir(version)
+	if _, err := os.Stat(dest); err == nil {
+		os.RemoveAll(tmp)
+		return nil
+	}
+	return os.Rename(tmp, dest)
+}
+
+// install unpacks release r, if not installed yet.
+func (m *Manager) install(r *Release) error {
+	if _, err := os.Stat(m.versionDir(r.Version)); err == nil {
+		return nil
+	}
+	managerLog.Infof("Installing lc0 %s from %s", r.Version, r.Name)
+	archive, err := m.fetch(r)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempDir(filepath.Join(m.dir, "versions"), ".install-")
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(r.Name, ".zip") {
+		err = extractZip(archive, tmp)
+	} else {
+		err = extractTar(archive, tmp)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := m.place(tmp, r.Version); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	os.Remove(archive)
+	return nil
+}
+
+// build builds lc0 from the source tree and installs it, returning the
+// version it was installed as. Builds are told apart by the build time.
+func (m *Manager) build() (string, error) {
+	src := m.config.Source
+	run := func(name string, args ...string) error {
+		cmd := exec.Command(name, args...)
+		cmd.Dir = src
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+			return fmt.Errorf("%s: %v: %s", name, err, lines[len(lines)-1])
+		}
+		return nil
+	}
+	managerLog.Infof("Building lc0 in %s", src)
+	if _, err := os.Stat(filepath.Join(src, "build", "build.ninja")); err != nil {
+		if err := run("meson", "setup", "build", "--buildtype", "release", "-Db_lto=true", "-Dgtest=false"); err != nil {
+			return "", err
+		}
+	}
+	if err := run("ninja", "-C", "build"); err != nil {
+		return "", err
+	}
+	built := filepath.Join(src, "build", exeName())
+	caps, err := capabilities.Probe(built)
+	if err != nil {
+		return "", err
+	}
+	if caps.Version == "" {
+		return "", errors.New("the built lc0 does not report its version")
+	}
+	version := strings.SplitN(caps.Version, "+", 2)[0] + "+built." + time.Now().Format("20060102150405")
+	tmp, err := ioutil.TempDir(filepath.Join(m.dir, "versions"), ".build-")
+	if err != nil {
+		return "", err
+	}
+	if err := copyFile(built, filepath.Join(tmp, exeName())); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	os.Chmod(filepath.Join(tmp, exeName()), 0755)
+	if err := m.place(tmp, version); err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return version, nil
+}
+
+func (m *Manager) installed() ([]string, error) {
+	entries, err := ioutil.ReadDir(filepath.Join(m.dir, "versions"))
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			versions = append(versions, e.Name())
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return compare(versions[i], versions[j]) > 0
+	})
+	return versions, nil
+}
+
+// prune deletes the oldest versions beyond the ones to keep.
+func (m *Manager) prune(s *state) {
+	if m.config.Keep <= 0 {
+		return
+	}
+	versions, err := m.installed()
+	if err != nil {
+		return
+	}
+	kept := 0
+	for _, v := range versions {
+		if v == s.Current || v == s.Previous {
+			continue
+		}
+		kept++
+		if kept > m.config.Keep {
+			managerLog.Infof("Removing lc0 %s", v)
+			os.RemoveAll(m.versionDir(v))
+		}
+	}
+}
+
+// usable reports whether version may be run.
+func usable(s *state, version string, minimum string) bool {
+	return version != "" && !s.rejected(version) && (minimum == "" || compare(version, minimum) >= 0)
+}
+
+// Update installs the newest fitting release, or builds lc0 if no release
+// fits and the current version cannot be used, and switches to it if it
+// passes the probe. It returns the path of the lc0 to run. Failures keep the
+// current version, and if that fails the probe, the previous one is used. A
+// version rolled back to is kept while it can be used, until Unpin.
+func (m *Manager) Update(minimum string) (string, error) {
+	unlock, err := m.lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	s, err := m.readState()
+	if err != nil {
+		return "", err
+	}
+	if s.Current != "" {
+		if err := m.check(s.Current); err != nil {
+			managerLog.Warnf("lc0 %s failed the probe: %v", s.Current, err)
+			if s.Previous == "" || m.switchTo(s, s.Previous) != nil {
+				s.Current = ""
+			}
+		}
+	}
+	pinned := s.Pinned != "" && s.Current == s.Pinned && usable(s, s.Current, minimum)
+	if pinned {
+		managerLog.Infof("Keeping lc0 %s, which was rolled back to, until lc0 is updated explicitly", s.Current)
+	}
+	if m.config.Releases != "" && !pinned {
+		releases, err := m.Available()
+		if err != nil {
+			managerLog.Warnf("Unable to list lc0 releases: %v", err)
+		}
+		// Try older releases while the picked ones are broken.
+		for err == nil {
+			r := pick(releases, s, minimum)
+			if r == nil || r.Version == s.Current || (usable(s, s.Current, minimum) && compare(r.Version, s.Current) <= 0) {
+				break
+			}
+			if err = m.install(r); err != nil {
+				managerLog.Warnf("Unable to install lc0 %s: %v", r.Version, err)
+				break
+			}
+			if err = m.switchTo(s, r.Version); err != nil {
+				managerLog.Warnf("%v, removing it", err)
+				os.RemoveAll(m.versionDir(r.Version))
+				s.Broken = append(s.Broken, r.Version)
+				if err = m.writeState(s); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+	if !usable(s, s.Current, minimum) && m.config.Source != "" {
+		version, err := m.build()
+		if err != nil {
+			managerLog.Warnf("Unable to build lc0: %v", err)
+		} else if err := m.switchTo(s, version); err != nil {
+			managerLog.Warnf("%v, not switching to it", err)
+		}
+	}
+	if s.Current == "" {
+		return "", errors.New("no lc0 is installed and none could be installed")
+	}
+	m.prune(s)
+	return m.exe(s.Current)
+}
+
+// RejectCurrent records that the current version is not accepted, so that
+// Update replaces it.
+func (m *Manager) RejectCurrent() error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s, err := m.readState()
+	if err != nil {
+		return err
+	}
+	if s.Current != "" && !s.rejected(s.Current) {
+		s.Rejected = append(s.Rejected, s.Current)
+	}
+	return m.writeState(s)
+}
+
+// Unpin lets Update replace a version rolled back to.
+func (m *Manager) Unpin() error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	s, err := m.readState()
+	if err != nil {
+		return err
+	}
+	if s.Pinned == "" {
+		return nil
+	}
+	s.Pinned = ""
+	return m.writeState(s)
+}
+
+// Rollback switches back to the previous version, and uses it even if the
+// server refused it. Update keeps it until Unpin.
+func (m *Manager) Rollback() (string, error) {
+	unlock, err := m.lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	s, err := m.readState()
+	if err != nil {
+		return "", err
+	}
+	if s.Previous == "" {
+		return "", errors.New("there is no previous lc0 version")
+	}
+	var rejected []string
+	for _, v := range s.Rejected {
+		if v != s.Previous {
+			rejected = append(rejected, v)
+		}
+	}
+	s.Rejected = rejected
+	if err := m.switchTo(s, s.Previous); err != nil {
+		return "", err
+	}
+	s.Pinned = s.Current
+	if err := m.writeState(s); err != nil {
+		return "", err
+	}
+	return s.Current, nil
+}
+
+// List returns the installed versions, newest first.
+func (m *Manager) List() ([]Installed, error) {
+	s, err := m.readState()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := m.installed()
+	if err != nil {
+		return nil, err
+	}
+	var list []Installed
+	for _, v := range versions {
+		list = append(list, Installed{Version: v, Current: v == s.Current, Previous: v == s.Previous, Rejected: s.rejected(v), Pinned: v == s.Pinned})
+	}
+	return list, nil
+}
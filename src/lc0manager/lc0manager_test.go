@@ -0,0 +1,246 @@
+package lc0manager
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeLc0 answers the capability probe like lc0 of version does, or fails
+// it if broken.
+func fakeLc0(version string, broken bool) string {
+	if broken {
+		return "#!/bin/sh\nexit 1\n"
+	}
+	return fmt.Sprintf(`#!/bin/sh
+echo "|_ |_ |_| %s built Jan 1 2026"
+echo "  -b,  --backend=cuda-auto"
+echo "  [UCI: Backend  DEFAULT: cuda-auto  VALUES: cuda-auto,eigen,check]"
+`, version)
+}
+
+// releases serves release archives and their SHA256SUMS from a temporary
+// directory.
+type releases struct {
+	t      *testing.T
+	dir    string
+	sums   bytes.Buffer
+	server *httptest.Server
+}
+
+func newReleases(t *testing.T) *releases {
+	dir, err := ioutil.TempDir("", "releases")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &releases{t: t, dir: dir}
+	r.server = httptest.NewServer(http.FileServer(http.Dir(dir)))
+	return r
+}
+
+func (r *releases) close() {
+	r.server.Close()
+	os.RemoveAll(r.dir)
+}
+
+// add publishes a release, listed with sha if it is not empty.
+func (r *releases) add(version string, broken bool, sha string) {
+	var buf bytes.Buffer
+	z := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(z)
+	script := fakeLc0(version, broken)
+	tw.WriteHeader(&tar.Header{Name: "lc0-" + version + "/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "lc0-" + version + "/lc0", Typeflag: tar.TypeReg, Mode: 0755, Size: int64(len(script))})
+	tw.Write([]byte(script))
+	tw.Close()
+	z.Close()
+	name := "lc0-" + version + "-linux.tar.gz"
+	if err := ioutil.WriteFile(filepath.Join(r.dir, name), buf.Bytes(), 0644); err != nil {
+		r.t.Fatal(err)
+	}
+	if sha == "" {
+		sha = fmt.Sprintf("%x", sha256.Sum256(buf.Bytes()))
+	}
+	fmt.Fprintf(&r.sums, "%s  %s\n", sha, name)
+	if err := ioutil.WriteFile(filepath.Join(r.dir, "SHA256SUMS"), r.sums.Bytes(), 0644); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+func (r *releases) manager() *Manager {
+	dir, err := ioutil.TempDir("", "lc0manager")
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	m, err := Open(dir, r.server.Client(), Config{Releases: r.server.URL + "/", Variant: "linux", Keep: 1})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return m
+}
+
+func skipOnWindows(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake lc0 is a shell script")
+	}
+}
+
+func TestPick(t *testing.T) {
+	available := []Release{{Version: "v0.32.0-rc2"}, {Version: "v0.32.0-rc1"}, {Version: "v0.31.2"}, {Version: "v0.31.1"}}
+	tests := []struct {
+		name     string
+		state    state
+		minimum  string
+		releases []Release
+		want     string
+	}{
+		{"newest release", state{}, "", available, "v0.31.2"},
+		{"refused release", state{Rejected: []string{"v0.31.2"}}, "", available, "v0.32.0-rc2"},
+		{"refused candidate", state{Rejected: []string{"v0.31.2", "v0.32.0-rc2"}}, "", available, "v0.31.1"},
+		{"refused everything newer", state{Rejected: []string{"v0.32.0-rc1", "v0.32.0-rc2"}}, "", available, "v0.31.2"},
+		{"broken release", state{Broken: []string{"v0.31.2"}}, "", available, "v0.31.1"},
+		{"minimum", state{}, "v0.31.2", available, "v0.31.2"},
+		{"candidate above minimum", state{}, "v0.31.3", available, "v0.32.0-rc2"},
+		{"nothing new enough", state{}, "v0.33.0", available, ""},
+		{"no releases", state{}, "", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if r := pick(tt.releases, &tt.state, tt.minimum); r != nil {
+				got = r.Version
+			}
+			if got != tt.want {
+				t.Errorf("pick() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func current(t *testing.T, m *Manager) *state {
+	s, err := m.readState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestUpdate(t *testing.T) {
+	skipOnWindows(t)
+	tests := []struct {
+		name string
+		// Releases, the last one broken if broken is set.
+		versions    []string
+		broken      bool
+		minimum     string
+		wantCurrent string
+		wantBroken  []string
+	}{
+		{name: "newest", versions: []string{"v0.31.1", "v0.31.2"}, wantCurrent: "v0.31.2"},
+		{name: "broken newest", versions: []string{"v0.31.1", "v0.31.2"}, broken: true,
+			wantCurrent: "v0.31.1", wantBroken: []string{"v0.31.2"}},
+		{name: "candidate for minimum", versions: []string{"v0.31.2", "v0.32.0-rc1"}, minimum: "v0.32.0-rc1",
+			wantCurrent: "v0.32.0-rc1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newReleases(t)
+			defer r.close()
+			for i, v := range tt.versions {
+				r.add(v, tt.broken && i == len(tt.versions)-1, "")
+			}
+			m := r.manager()
+			defer os.RemoveAll(m.dir)
+			exe, err := m.Update(tt.minimum)
+			if err != nil {
+				t.Fatalf("Update() = %v", err)
+			}
+			want := filepath.Join(m.dir, "versions", tt.wantCurrent, "lc0-"+tt.wantCurrent, "lc0")
+			if exe != want {
+				t.Errorf("Update() = %s, want %s", exe, want)
+			}
+			s := current(t, m)
+			if s.Current != tt.wantCurrent || fmt.Sprint(s.Broken) != fmt.Sprint(tt.wantBroken) {
+				t.Errorf("state = %+v, want current %s and broken %v", s, tt.wantCurrent, tt.wantBroken)
+			}
+		})
+	}
+}
+
+func TestUpdateChecksumMismatch(t *testing.T) {
+	skipOnWindows(t)
+	r := newReleases(t)
+	defer r.close()
+	r.add("v0.31.2", false, strings.Repeat("0", 64))
+	m := r.manager()
+	defer os.RemoveAll(m.dir)
+	if _, err := m.Update(""); err == nil {
+		t.Fatal("Update() of a release with the wrong checksum succeeded")
+	}
+	if s := current(t, m); s.Current != "" {
+		t.Errorf("current version = %s, want none", s.Current)
+	}
+	if _, err := os.Stat(filepath.Join(m.dir, "downloads", "lc0-v0.31.2-linux.tar.gz")); !os.IsNotExist(err) {
+		t.Errorf("the archive with the wrong checksum was kept: %v", err)
+	}
+	if _, err := os.Stat(m.versionDir("v0.31.2")); !os.IsNotExist(err) {
+		t.Errorf("the release with the wrong checksum was installed: %v", err)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	skipOnWindows(t)
+	r := newReleases(t)
+	defer r.close()
+	m := r.manager()
+	defer os.RemoveAll(m.dir)
+	if _, err := m.Rollback(); err == nil {
+		t.Error("Rollback() without a previous version succeeded")
+	}
+	r.add("v0.31.1", false, "")
+	if _, err := m.Update(""); err != nil {
+		t.Fatal(err)
+	}
+	r.add("v0.31.2", false, "")
+	if _, err := m.Update(""); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name        string
+		do          func() error
+		wantCurrent string
+		wantPinned  string
+	}{
+		{"rollback", func() error { _, err := m.Rollback(); return err }, "v0.31.1", "v0.31.1"},
+		{"update keeps it", func() error { _, err := m.Update(""); return err }, "v0.31.1", "v0.31.1"},
+		{"unpin", m.Unpin, "v0.31.1", ""},
+		{"update after unpin", func() error { _, err := m.Update(""); return err }, "v0.31.2", ""},
+		{"newer release", func() error {
+			r.add("v0.31.3", false, "")
+			_, err := m.Update("")
+			return err
+		}, "v0.31.3", ""},
+		{"rollback again", func() error { _, err := m.Rollback(); return err }, "v0.31.2", "v0.31.2"},
+		{"minimum replaces it", func() error { _, err := m.Update("v0.31.3"); return err }, "v0.31.3", ""},
+	}
+	for _, step := range steps {
+		if err := step.do(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		s := current(t, m)
+		if s.Current != step.wantCurrent || s.Pinned != step.wantPinned {
+			t.Errorf("%s: current %s pinned %q, want %s and %q", step.name, s.Current, s.Pinned, step.wantCurrent, step.wantPinned)
+		}
+	}
+}
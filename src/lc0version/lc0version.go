@@ -0,0 +1,148 @@
+// Package lc0version compares lc0 versions and checks them against the
+// versions the client or the server require.
+//
+// Versions look like v0.31.2, v0.32.0-rc1 or v0.32.0-dev+git.abc1234. A
+// release candidate or development build comes before the release of the
+// same number.
+package lc0version
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Builtin is used until the server says otherwise: the oldest lc0 the client
+// works with, and the latest release when the client was built.
+var Builtin = Requirement{Minimum: "v0.28.0", Recommended: "v0.31.2", Source: "this client"}
+
+// Version is a parsed lc0 version.
+type Version struct {
+	Major, Minor, Patch int
+	// The pre-release part, like rc1 or dev, empty for releases.
+	Pre string
+}
+
+var versionRegex = regexp.MustCompile(`^v?(\d+)\.(\d+)(?:\.(\d+))?(?:-([0-9A-Za-z.]+))?(?:\+\S*)?$`)
+
+// Parse parses a version such as v0.31.2-rc1.
+func Parse(s string) (Version, error) {
+	m := versionRegex.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return Version{}, fmt.Errorf("%q is not an lc0 version", s)
+	}
+	v := Version{Pre: m[4]}
+	v.Major, _ = strconv.Atoi(m[1])
+	v.Minor, _ = strconv.Atoi(m[2])
+	if m[3] != "" {
+		v.Patch, _ = strconv.Atoi(m[3])
+	}
+	return v, nil
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("v%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Pre != "" {
+		s += "-" + v.Pre
+	}
+	return s
+}
+
+// preRank orders pre-releases: development builds, then release
+// candidates, then the release.
+func preRank(pre string) (int, int) {
+	switch {
+	case pre == "":
+		return 2, 0
+	case strings.HasPrefix(pre, "rc"):
+		n, _ := strconv.Atoi(pre[2:])
+		return 1, n
+	}
+	return 0, 0
+}
+
+func compareInts(a int, b int) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+// Compare returns -1, 0 or 1 as v is older than, the same as or newer than
+// o.
+func (v Version) Compare(o Version) int {
+	for _, c := range []int{compareInts(v.Major, o.Major), compareInts(v.Minor, o.Minor), compareInts(v.Patch, o.Patch)} {
+		if c != 0 {
+			return c
+		}
+	}
+	vr, vn := preRank(v.Pre)
+	or, on := preRank(o.Pre)
+	if c := compareInts(vr, or); c != 0 {
+		return c
+	}
+	return compareInts(vn, on)
+}
+
+// Prerelease describes version if it is not a release, or returns "".
+func Prerelease(version string) string {
+	v, err := Parse(version)
+	switch {
+	case err != nil:
+		return ""
+	case strings.Contains(v.Pre, "dev"):
+		return "an unreleased development version"
+	case strings.HasPrefix(v.Pre, "rc"):
+		return "a release candidate"
+	case v.Pre != "":
+		return "a pre-release"
+	}
+	return ""
+}
+
+// Requirement is what a version is checked against. Empty versions are not
+// checked.
+type Requirement struct {
+	Minimum     string
+	Recommended string
+	// Who requires it, for messages.
+	Source string
+}
+
+// Check returns an error if version is older than the minimum, and a warning
+// if it is older than the recommended version or either cannot be parsed.
+func (r Requirement) Check(version string) (string, error) {
+	if r.Minimum == "" && r.Recommended == "" {
+		return "", nil
+	}
+	v, err := Parse(version)
+	if err != nil {
+		if version == "" {
+			return "lc0 did not report its version, so it cannot be checked", nil
+		}
+		return fmt.Sprintf("Unable to check the lc0 version: %v", err), nil
+	}
+	if r.Minimum != "" {
+		min, err := Parse(r.Minimum)
+		if err != nil {
+			return fmt.Sprintf("The minimum lc0 version of %s: %v", r.Source, err), nil
+		}
+		if v.Compare(min) < 0 {
+			return "", fmt.Errorf("lc0 %s is older than %s, the oldest version %s accepts", version, r.Minimum, r.Source)
+		}
+	}
+	if r.Recommended != "" {
+		rec, err := Parse(r.Recommended)
+		if err != nil {
+			return fmt.Sprintf("The recommended lc0 version of %s: %v", r.Source, err), nil
+		}
+		if v.Compare(rec) < 0 {
+			return fmt.Sprintf("lc0 %s is older than %s, the version %s recommends", version, r.Recommended, r.Source), nil
+		}
+	}
+	return "", nil
+}
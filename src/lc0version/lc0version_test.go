@@ -0,0 +1,120 @@
+package lc0version
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input string
+		want  string
+		ok    bool
+	}{
+		{"v0.31.2", "v0.31.2", true},
+		{"0.31.2", "v0.31.2", true},
+		{" v0.31 ", "v0.31.0", true},
+		{"v0.32.0-rc1", "v0.32.0-rc1", true},
+		{"v0.32.0-dev+git.abc1234", "v0.32.0-dev", true},
+		{"v1", "", false},
+		{"latest", "", false},
+		{"v0.31.2 built Jan 1", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		v, err := Parse(tt.input)
+		if (err == nil) != tt.ok {
+			t.Errorf("Parse(%q) = %v, want ok %v", tt.input, err, tt.ok)
+			continue
+		}
+		if tt.ok && v.String() != tt.want {
+			t.Errorf("Parse(%q) = %s, want %s", tt.input, v, tt.want)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"v0.31.2", "v0.31.2", 0},
+		{"v0.31", "v0.31.0", 0},
+		{"v0.31.1", "v0.31.2", -1},
+		{"v0.31.10", "v0.31.2", 1},
+		{"v0.30.9", "v0.31.0", -1},
+		{"v1.0.0", "v0.99.99", 1},
+		{"v0.32.0-rc1", "v0.32.0", -1},
+		{"v0.32.0-rc1", "v0.31.2", 1},
+		{"v0.32.0-rc2", "v0.32.0-rc1", 1},
+		{"v0.32.0-rc10", "v0.32.0-rc9", 1},
+		{"v0.32.0-dev", "v0.32.0-rc1", -1},
+		{"v0.32.0-dev+git.abc", "v0.32.0-dev+git.def", 0},
+	}
+	for _, tt := range tests {
+		a, err := Parse(tt.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := Parse(tt.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := a.Compare(b); got != tt.want {
+			t.Errorf("%s.Compare(%s) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := b.Compare(a); got != -tt.want {
+			t.Errorf("%s.Compare(%s) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+	}
+}
+
+func TestPrerelease(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string
+	}{
+		{"v0.31.2", ""},
+		{"v0.32.0-rc1", "a release candidate"},
+		{"v0.32.0-dev+git.abc", "an unreleased development version"},
+		{"v0.32.0-beta", "a pre-release"},
+		{"unknown", ""},
+	}
+	for _, tt := range tests {
+		if got := Prerelease(tt.version); got != tt.want {
+			t.Errorf("Prerelease(%q) = %q, want %q", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	r := Requirement{Minimum: "v0.30.0", Recommended: "v0.31.2", Source: "the server"}
+	tests := []struct {
+		name        string
+		req         Requirement
+		version     string
+		wantWarning string
+		wantErr     string
+	}{
+		{"recommended", r, "v0.31.2", "", ""},
+		{"newer", r, "v0.32.0-rc1", "", ""},
+		{"outdated", r, "v0.30.1", "the version the server recommends", ""},
+		{"too old", r, "v0.29.0", "", "the oldest version the server accepts"},
+		{"rc of minimum", r, "v0.30.0-rc2", "", "older than v0.30.0"},
+		{"unknown", r, "", "did not report its version", ""},
+		{"unparsable", r, "lc0", "Unable to check", ""},
+		{"bad minimum", Requirement{Minimum: "new", Source: "x"}, "v0.31.2", "The minimum lc0 version of x", ""},
+		{"no requirement", Requirement{}, "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warning, err := tt.req.Check(tt.version)
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Check(%q) error = %v, want %q", tt.version, err, tt.wantErr)
+			}
+			if tt.wantWarning == "" && warning != "" || !strings.Contains(warning, tt.wantWarning) {
+				t.Errorf("Check(%q) warning = %q, want %q", tt.version, warning, tt.wantWarning)
+			}
+		})
+	}
+}
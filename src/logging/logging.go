@@ -0,0 +1,209 @@
+// Package logging provides leveled, component tagged logging with optional
+// JSON output.
+//
+// Every line carries a component tag such as "engine", "uploader", "cache" or
+// "scheduler" so output can be filtered and aggregated. The raw output of lc0
+// can be sent to its own stream with SetEngineOutput.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log line.
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel converts a level name to a Level.
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q, use one of %s", name, strings.Join(levelNames, ", "))
+}
+
+var (
+	mutex        sync.Mutex
+	minLevel     = Info
+	jsonOutput   bool
+	prefix       string
+	output       io.Writer = os.Stderr
+	engineOutput io.Writer
+	onFatal      func(msg string)
+)
+
+// SetLevel sets the lowest level that is logged.
+func SetLevel(l Level) {
+	mutex.Lock()
+	minLevel = l
+	mutex.Unlock()
+}
+
+// SetJSON switches between text and JSON lines output.
+func SetJSON(enabled bool) {
+	mutex.Lock()
+	jsonOutput = enabled
+	mutex.Unlock()
+}
+
+// SetPrefix sets a prefix for all text lines.
+func SetPrefix(p string) {
+	mutex.Lock()
+	prefix = p
+	mutex.Unlock()
+}
+
+// SetOutput sets where log lines are written, stderr by default.
+func SetOutput(w io.Writer) {
+	mutex.Lock()
+	output = w
+	mutex.Unlock()
+}
+
+// OnFatal sets a function that Fatalf calls with the message before exiting.
+func OnFatal(fn func(msg string)) {
+	mutex.Lock()
+	onFatal = fn
+	mutex.Unlock()
+}
+
+// SetEngineOutput sends raw lc0 output lines to w instead of logging them
+// with the engine component. A nil w restores the default.
+func SetEngineOutput(w io.Writer) {
+	mutex.Lock()
+	engineOutput = w
+	mutex.Unlock()
+}
+
+type entry struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Component string `json:"component"`
+	Caller    string `json:"caller,omitempty"`
+	Msg       string `json:"msg"`
+}
+
+func write(level Level, component string, depth int, msg string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if level < minLevel {
+		return
+	}
+	caller := ""
+	if _, file, line, ok := runtime.Caller(depth + 1); ok {
+		caller = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+	now := time.Now()
+	msg = strings.TrimRight(msg, "\n")
+	if jsonOutput {
+		b, err := json.Marshal(entry{
+			Time:      now.Format(time.RFC3339Nano),
+			Level:     level.String(),
+			Component: component,
+			Caller:    caller,
+			Msg:       msg,
+		})
+		if err == nil {
+			output.Write(append(b, '\n'))
+		}
+		return
+	}
+	fmt.Fprintf(output, "%s%s %-5s [%s] %s: %s\n", prefix, now.Format("2006/01/02 15:04:05"),
+		strings.ToUpper(level.String()), component, caller, msg)
+}
+
+// Logger logs lines tagged with a component.
+type Logger struct {
+	component string
+}
+
+// New returns a logger for component.
+func New(component string) *Logger {
+	return &Logger{component: component}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	write(Debug, l.component, 1, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	write(Info, l.component, 1, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	write(Warn, l.component, 1, fmt.Sprintf(format, args...))
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	write(Error, l.component, 1, fmt.Sprintf(format, args...))
+}
+
+// Fatalf logs at the error level and exits.
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	write(Error, l.component, 1, msg)
+	mutex.Lock()
+	fn := onFatal
+	mutex.Unlock()
+	if fn != nil {
+		fn(msg)
+	}
+	os.Exit(1)
+}
+
+// EngineLine handles a line of raw lc0 output, logged at level unless raw
+// output goes to its own stream.
+func EngineLine(level Level, line string) {
+	mutex.Lock()
+	w := engineOutput
+	mutex.Unlock()
+	if w != nil {
+		io.WriteString(w, line+"\n")
+		return
+	}
+	write(level, "engine", 1, line)
+}
+
+// Writer returns a writer logging each line written at level, to route the
+// standard log package through here.
+func (l *Logger) Writer(level Level) io.Writer {
+	return &lineWriter{logger: l, level: level}
+}
+
+type lineWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		// Skip the log package and this writer in the caller.
+		write(w.level, w.logger.component, 3, line)
+	}
+	return len(p), nil
+}
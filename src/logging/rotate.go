@@ -0,0 +1,162 @@
+package logging
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotatingFile is a log file in a directory that is rotated once it grows
+// past a size or age. Rotated files get a timestamp suffix and only the most
+// recent ones are kept.
+type RotatingFile struct {
+	mutex   sync.Mutex
+	dir     string
+	name    string
+	maxSize int64
+	maxAge  time.Duration
+	keep    int
+	file    *os.File
+	size    int64
+	opened  time.Time
+}
+
+// NewRotatingFile opens (appending to) name in dir. A zero maxSize or maxAge
+// disables that rotation trigger.
+func NewRotatingFile(dir string, name string, maxSize int64, maxAge time.Duration, keep int) (*RotatingFile, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	r := &RotatingFile{dir: dir, name: name, maxSize: maxSize, maxAge: maxAge, keep: keep}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) path() string {
+	return filepath.Join(r.dir, r.name+".log")
+}
+
+func (r *RotatingFile) open() error {
+	file, err := os.OpenFile(r.path(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = fi.Size()
+	r.opened = time.Now()
+	if r.size > 0 {
+		// The age counts from the first line, not from this restart.
+		r.opened = firstLineTime(r.path(), fi.ModTime())
+	}
+	return nil
+}
+
+var textTimeRegex = regexp.MustCompile(`\d{4}/\d\d/\d\d \d\d:\d\d:\d\d`)
+
+// firstLineTime returns the time the first line of the log at path was
+// written, or fallback if that cannot be told.
+func firstLineTime(path string, fallback time.Time) time.Time {
+	file, err := os.Open(path)
+	if err != nil {
+		return fallback
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	if !scanner.Scan() {
+		return fallback
+	}
+	line := scanner.Text()
+	var e entry
+	if json.Unmarshal([]byte(line), &e) == nil {
+		if t, err := time.Parse(time.RFC3339Nano, e.Time); err == nil {
+			return t
+		}
+	}
+	if m := textTimeRegex.FindString(line); m != "" {
+		if t, err := time.ParseInLocation("2006/01/02 15:04:05", m, time.Local); err == nil {
+			return t
+		}
+	}
+	return fallback
+}
+
+func (r *RotatingFile) rotate() error {
+	r.file.Close()
+	rotated := filepath.Join(r.dir, fmt.Sprintf("%s-%s.log", r.name, time.Now().Format("20060102-150405.000")))
+	if err := os.Rename(r.path(), rotated); err != nil {
+		// Keep writing to the current file rather than a closed one.
+		if openErr := r.open(); openErr != nil {
+			r.file = nil
+		}
+		return err
+	}
+	Prune(r.dir, r.name+"-", r.keep)
+	return r.open()
+}
+
+// Write appends p, rotating the file first if needed.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size > 0 && ((r.maxSize > 0 && r.size+int64(len(p)) > r.maxSize) ||
+		(r.maxAge > 0 && time.Since(r.opened) > r.maxAge)) {
+		// If only the rename failed, keep writing and try again next time.
+		if err := r.rotate(); err != nil && r.file == nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file.
+func (r *RotatingFile) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+// Prune removes all but the keep most recent files in dir whose name starts
+// with prefix. Names are expected to sort by time.
+func Prune(dir string, prefix string, keep int) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasPrefix(f.Name(), prefix) {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	for len(names) > keep {
+		os.Remove(filepath.Join(dir, names[0]))
+		names = names[1:]
+	}
+}
@@ -0,0 +1,138 @@
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// logs returns the rotated logs of name in dir, oldest first, and the
+// contents of the current one.
+func logs(t *testing.T, dir string, name string) ([]string, string) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rotated []string
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), name+"-") {
+			rotated = append(rotated, f.Name())
+		}
+	}
+	sort.Strings(rotated)
+	current, _ := ioutil.ReadFile(filepath.Join(dir, name+".log"))
+	return rotated, string(current)
+}
+
+func TestRotateBySize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r, err := NewRotatingFile(dir, "client", 25, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for _, line := range []string{"line 1...\n", "line 2...\n", "line 3...\n", "line 4...\n", "line 5...\n", "line 6...\n", "line 7...\n"} {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+		// Rotated names have millisecond timestamps.
+		time.Sleep(2 * time.Millisecond)
+	}
+	rotated, current := logs(t, dir, "client")
+	if len(rotated) != 2 {
+		t.Errorf("rotated logs = %v, want the 2 most recent", rotated)
+	}
+	if current != "line 7...\n" {
+		t.Errorf("current log = %q, want the last line", current)
+	}
+	if len(rotated) > 0 {
+		last, _ := ioutil.ReadFile(filepath.Join(dir, rotated[len(rotated)-1]))
+		if string(last) != "line 5...\nline 6...\n" {
+			t.Errorf("last rotated log = %q", last)
+		}
+	}
+}
+
+func TestRotateByAge(t *testing.T) {
+	old := time.Now().Add(-2 * time.Hour)
+	tests := []struct {
+		name       string
+		first      string
+		wantRotate bool
+	}{
+		{"json", `{"time":"` + old.Format(time.RFC3339Nano) + `","level":"INFO","msg":"hi"}`, true},
+		{"text", old.Format("2006/01/02 15:04:05") + " INFO  [client] hi", true},
+		{"recent json", `{"time":"` + time.Now().Format(time.RFC3339Nano) + `","msg":"hi"}`, false},
+		// The file was just written, so its modification time is recent.
+		{"no time", "hello", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "rotate")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			if err := ioutil.WriteFile(filepath.Join(dir, "client.log"), []byte(tt.first+"\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			r, err := NewRotatingFile(dir, "client", 0, time.Hour, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			r.Write([]byte("next\n"))
+			rotated, current := logs(t, dir, "client")
+			if tt.wantRotate && (len(rotated) != 1 || current != "next\n") {
+				t.Errorf("rotated logs = %v, current %q, want the old log rotated", rotated, current)
+			}
+			if !tt.wantRotate && (len(rotated) != 0 || current != tt.first+"\nnext\n") {
+				t.Errorf("rotated logs = %v, current %q, want no rotation", rotated, current)
+			}
+		})
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	r, err := NewRotatingFile(dir, "client", 0, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if _, err := r.Write([]byte("late\n")); err == nil {
+		t.Error("Write() after Close() succeeded")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "prune")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"lc0-20260101.log", "lc0-20260103.log", "lc0-20260102.log", "client.log"} {
+		ioutil.WriteFile(filepath.Join(dir, name), nil, 0644)
+	}
+	Prune(dir, "lc0-", 1)
+	files, _ := ioutil.ReadDir(dir)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	if strings.Join(names, " ") != "client.log lc0-20260103.log" {
+		t.Errorf("after Prune() = %v, want client.log and the newest lc0 log", names)
+	}
+}
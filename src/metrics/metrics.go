@@ -0,0 +1,240 @@
+// Package metrics is a minimal Prometheus instrumentation library.
+//
+// Metrics are registered globally when created and exposed in the Prometheus
+// text format by Handler.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	registryMutex sync.Mutex
+	registry      []*family
+)
+
+type kind string
+
+const (
+	counterKind   kind = "counter"
+	gaugeKind     kind = "gauge"
+	histogramKind kind = "histogram"
+)
+
+// series holds the values for one set of label values.
+type series struct {
+	labelValues []string
+	value       float64
+	// Histograms only.
+	buckets []uint64
+	count   uint64
+}
+
+type family struct {
+	name    string
+	help    string
+	kind    kind
+	labels  []string
+	bounds  []float64
+	mutex   sync.Mutex
+	entries map[string]*series
+}
+
+func newFamily(name string, help string, k kind, labels []string) *family {
+	f := &family{name: name, help: help, kind: k, labels: labels, entries: map[string]*series{}}
+	registryMutex.Lock()
+	registry = append(registry, f)
+	registryMutex.Unlock()
+	return f
+}
+
+// get returns the series for labelValues, creating it if needed. The caller
+// must hold f.mutex.
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.entries[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.kind == histogramKind {
+			s.buckets = make([]uint64, len(f.bounds))
+		}
+		f.entries[key] = s
+	}
+	return s
+}
+
+// Counter is a value that only goes up.
+type Counter struct{ f *family }
+
+// NewCounter registers a counter with the given label names.
+func NewCounter(name string, help string, labels ...string) *Counter {
+	return &Counter{newFamily(name, help, counterKind, labels)}
+}
+
+// Add adds v to the counter for the label values.
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.f.mutex.Lock()
+	c.f.get(labelValues).value += v
+	c.f.mutex.Unlock()
+}
+
+// Inc adds one to the counter for the label values.
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct{ f *family }
+
+// NewGauge registers a gauge with the given label names.
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	return &Gauge{newFamily(name, help, gaugeKind, labels)}
+}
+
+// Set sets the gauge for the label values.
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.f.mutex.Lock()
+	g.f.get(labelValues).value = v
+	g.f.mutex.Unlock()
+}
+
+// Reset removes all label values of the gauge, for info style gauges where
+// only the current labels should be reported.
+func (g *Gauge) Reset() {
+	g.f.mutex.Lock()
+	g.f.entries = map[string]*series{}
+	g.f.mutex.Unlock()
+}
+
+// ResetMatching removes the label values of the gauge where label is value,
+// for info style gauges kept per GPU or the like.
+func (g *Gauge) ResetMatching(label string, value string) {
+	g.f.mutex.Lock()
+	defer g.f.mutex.Unlock()
+	for i, name := range g.f.labels {
+		if name != label {
+			continue
+		}
+		for key, s := range g.f.entries {
+			if s.labelValues[i] == value {
+				delete(g.f.entries, key)
+			}
+		}
+	}
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct{ f *family }
+
+// NewHistogram registers a histogram with the given bucket upper bounds,
+// which must be sorted. The +Inf bucket is implicit.
+func NewHistogram(name string, help string, bounds []float64, labels ...string) *Histogram {
+	f := newFamily(name, help, histogramKind, labels)
+	f.bounds = bounds
+	return &Histogram{f}
+}
+
+// Observe records v for the label values.
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.f.mutex.Lock()
+	s := h.f.get(labelValues)
+	for i, bound := range h.f.bounds {
+		if v <= bound {
+			s.buckets[i]++
+		}
+	}
+	s.count++
+	s.value += v
+	h.f.mutex.Unlock()
+}
+
+// ExponentialBuckets returns count bounds starting at start, each factor
+// times the previous one.
+func ExponentialBuckets(start float64, factor float64, count int) []float64 {
+	bounds := make([]float64, count)
+	for i := range bounds {
+		bounds[i] = start
+		start *= factor
+	}
+	return bounds
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	var parts []string
+	for i, name := range names {
+		parts = append(parts, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+`="`+extraValue+`"`)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (f *family) write(w io.Writer) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, strings.Replace(f.help, "\n", " ", -1))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+	keys := make([]string, 0, len(f.entries))
+	for key := range f.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.entries[key]
+		if f.kind != histogramKind {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), formatFloat(s.value))
+			continue
+		}
+		for i, bound := range f.bounds {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name,
+				formatLabels(f.labels, s.labelValues, "le", formatFloat(bound)), s.buckets[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), formatFloat(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), s.count)
+	}
+}
+
+// WriteText writes all registered metrics in the Prometheus text format.
+func WriteText(w io.Writer) {
+	registryMutex.Lock()
+	families := append([]*family(nil), registry...)
+	registryMutex.Unlock()
+	for _, f := range families {
+		f.write(w)
+	}
+}
+
+// Handler serves the registered metrics.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteText(w)
+	})
+}
@@ -0,0 +1,445 @@
+// Package netinfo decodes the header of lc0 network files.
+//
+// Network files are gzip compressed protobufs (see net.proto in the lc0
+// repository). Only the fields needed to describe the network are decoded,
+// so no protobuf library or lc0 binary is needed.
+package netinfo
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The magic number at the start of every lc0 network protobuf.
+const netMagic = 0x1c0
+
+// TrainingParams holds the optional training metadata stored in a network.
+type TrainingParams struct {
+	TrainingSteps uint32
+	LearningRate  float32
+	MseLoss       float32
+	PolicyLoss    float32
+	Accuracy      float32
+	Lc0Params     string
+}
+
+// Info describes a network file.
+type Info struct {
+	Magic           uint32
+	License         string
+	MinVersion      string
+	WeightsEncoding string
+	Input           string
+	Output          string
+	Network         string
+	Policy          string
+	Value           string
+	MovesLeft       string
+	Blocks          int
+	Filters         int
+	EncoderLayers   int
+	HasOnnx         bool
+	Training        *TrainingParams
+}
+
+var weightsEncodings = map[uint64]string{
+	0: "unknown",
+	1: "linear16",
+}
+
+var inputFormats = map[uint64]string{
+	0:   "unknown",
+	1:   "classical-112",
+	2:   "112-with-castling-plane",
+	3:   "112-with-canonicalization",
+	4:   "112-with-canonicalization-hectoplies",
+	5:   "112-with-canonicalization-v2",
+	132: "112-with-canonicalization-hectoplies-armageddon",
+	133: "112-with-canonicalization-v2-armageddon",
+}
+
+var outputFormats = map[uint64]string{
+	0: "unknown",
+	1: "classical",
+	2: "wdl",
+}
+
+var networkStructures = map[uint64]string{
+	0:   "unknown",
+	1:   "classical",
+	2:   "se",
+	3:   "classical-with-headformat",
+	4:   "se-with-headformat",
+	5:   "onnx",
+	6:   "attentionbody-with-headformat",
+	7:   "attentionbody-with-multiheadformat",
+	134: "ab-legacy-with-multiheadformat",
+}
+
+var policyFormats = map[uint64]string{
+	0: "unknown",
+	1: "classical",
+	2: "convolution",
+	3: "attention",
+}
+
+var valueFormats = map[uint64]string{
+	0: "unknown",
+	1: "classical",
+	2: "wdl",
+	3: "param",
+}
+
+var movesLeftFormats = map[uint64]string{
+	0: "none",
+	1: "v1",
+}
+
+// Bytes per parameter for each Layer.encoding value.
+var layerEncodingSizes = map[uint64]int{
+	0: 2, // Unknown, older nets are always linear16.
+	1: 2, // LINEAR16
+	2: 2, // FLOAT16
+	3: 2, // BFLOAT16
+	4: 4, // FLOAT32
+}
+
+func enumName(names map[uint64]string, v uint64) string {
+	if name, ok := names[v]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", v)
+}
+
+// The networks read last. Decoding one means decompressing all of its
+// weights, as the block count is only known by walking them.
+var (
+	cacheMutex sync.Mutex
+	cache      = map[string]cached{}
+)
+
+// How many networks to keep in the cache, a few per run is plenty.
+const cacheSize = 16
+
+type cached struct {
+	size    int64
+	modTime time.Time
+	info    *Info
+}
+
+// ReadFile decompresses and decodes the network at path. Networks read
+// before are not decoded again unless the file changed, so the returned
+// Info is shared and must not be modified.
+func ReadFile(path string) (*Info, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	cacheMutex.Lock()
+	c, ok := cache[path]
+	cacheMutex.Unlock()
+	if ok && c.size == fi.Size() && c.modTime.Equal(fi.ModTime()) {
+		return c.info, nil
+	}
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	info, err := Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	cacheMutex.Lock()
+	if len(cache) >= cacheSize {
+		cache = map[string]cached{}
+	}
+	cache[path] = cached{size: fi.Size(), modTime: fi.ModTime(), info: info}
+	cacheMutex.Unlock()
+	return info, nil
+}
+
+// Parse decodes an uncompressed network protobuf.
+func Parse(data []byte) (*Info, error) {
+	info := &Info{
+		WeightsEncoding: enumName(weightsEncodings, 0),
+		Input:           enumName(inputFormats, 0),
+		Output:          enumName(outputFormats, 0),
+		Network:         enumName(networkStructures, 0),
+		Policy:          enumName(policyFormats, 0),
+		Value:           enumName(valueFormats, 0),
+		MovesLeft:       enumName(movesLeftFormats, 0),
+	}
+	err := walk(data, func(num int, wire int, v uint64, b []byte) error {
+		switch {
+		case num == 1 && wire == wireFixed32:
+			info.Magic = uint32(v)
+		case num == 2 && wire == wireBytes:
+			info.License = string(b)
+		case num == 3 && wire == wireBytes:
+			return parseVersion(b, info)
+		case num == 4 && wire == wireBytes:
+			return parseFormat(b, info)
+		case num == 5 && wire == wireBytes:
+			info.Training = &TrainingParams{}
+			return parseTrainingParams(b, info.Training)
+		case num == 10 && wire == wireBytes:
+			return parseWeights(b, info)
+		case num == 11 && wire == wireBytes:
+			info.HasOnnx = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if info.Magic != netMagic {
+		return nil, fmt.Errorf("not an lc0 network (magic %#x)", info.Magic)
+	}
+	return info, nil
+}
+
+func parseVersion(data []byte, info *Info) error {
+	var parts [3]uint64
+	err := walk(data, func(num int, wire int, v uint64, b []byte) error {
+		if num >= 1 && num <= 3 && wire == wireVarint {
+			parts[num-1] = v
+		}
+		return nil
+	})
+	info.MinVersion = fmt.Sprintf("v%d.%d.%d", parts[0], parts[1], parts[2])
+	return err
+}
+
+func parseFormat(data []byte, info *Info) error {
+	return walk(data, func(num int, wire int, v uint64, b []byte) error {
+		switch {
+		case num == 1 && wire == wireVarint:
+			info.WeightsEncoding = enumName(weightsEncodings, v)
+		case num == 2 && wire == wireBytes:
+			return parseNetworkFormat(b, info)
+		}
+		return nil
+	})
+}
+
+func parseNetworkFormat(data []byte, info *Info) error {
+	return walk(data, func(num int, wire int, v uint64, b []byte) error {
+		if wire != wireVarint {
+			return nil
+		}
+		switch num {
+		case 1:
+			info.Input = enumName(inputFormats, v)
+		case 2:
+			info.Output = enumName(outputFormats, v)
+		case 3:
+			info.Network = enumName(networkStructures, v)
+		case 4:
+			info.Policy = enumName(policyFormats, v)
+		case 5:
+			info.Value = enumName(valueFormats, v)
+		case 6:
+			info.MovesLeft = enumName(movesLeftFormats, v)
+		}
+		return nil
+	})
+}
+
+func parseTrainingParams(data []byte, tp *TrainingParams) error {
+	return walk(data, func(num int, wire int, v uint64, b []byte) error {
+		switch {
+		case num == 1 && wire == wireVarint:
+			tp.TrainingSteps = uint32(v)
+		case num == 2 && wire == wireFixed32:
+			tp.LearningRate = math.Float32frombits(uint32(v))
+		case num == 3 && wire == wireFixed32:
+			tp.MseLoss = math.Float32frombits(uint32(v))
+		case num == 4 && wire == wireFixed32:
+			tp.PolicyLoss = math.Float32frombits(uint32(v))
+		case num == 5 && wire == wireFixed32:
+			tp.Accuracy = math.Float32frombits(uint32(v))
+		case num == 6 && wire == wireBytes:
+			tp.Lc0Params = string(b)
+		}
+		return nil
+	})
+}
+
+func parseWeights(data []byte, info *Info) error {
+	return walk(data, func(num int, wire int, v uint64, b []byte) error {
+		if wire != wireBytes {
+			return nil
+		}
+		switch num {
+		case 1:
+			// The input convolution, its output size is the filter count.
+			filters, err := convBlockOutputs(b)
+			if err != nil {
+				return err
+			}
+			if info.Filters == 0 {
+				info.Filters = filters
+			}
+		case 2:
+			info.Blocks++
+		case 27:
+			info.EncoderLayers++
+		}
+		return nil
+	})
+}
+
+// convBlockOutputs returns the number of output channels of a ConvBlock, as
+// given by the size of its biases (or batch norm means for older nets).
+func convBlockOutputs(data []byte) (int, error) {
+	outputs := 0
+	err := walk(data, func(num int, wire int, v uint64, b []byte) error {
+		if (num == 2 || num == 3) && wire == wireBytes && outputs == 0 {
+			n, err := layerSize(b)
+			if err != nil {
+				return err
+			}
+			outputs = n
+		}
+		return nil
+	})
+	return outputs, err
+}
+
+// layerSize returns the number of parameters in a Layer.
+func layerSize(data []byte) (int, error) {
+	var params []byte
+	var encoding uint64
+	var dims []int
+	err := walk(data, func(num int, wire int, v uint64, b []byte) error {
+		switch {
+		case num == 3 && wire == wireBytes:
+			params = b
+		case num == 4 && wire == wireVarint:
+			encoding = v
+		case num == 5 && wire == wireVarint:
+			dims = append(dims, int(v))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(dims) > 0 {
+		n := 1
+		for _, d := range dims {
+			n *= d
+		}
+		return n, nil
+	}
+	size, ok := layerEncodingSizes[encoding]
+	if !ok {
+		return 0, fmt.Errorf("unknown layer encoding %d", encoding)
+	}
+	return len(params) / size, nil
+}
+
+// Architecture describes the shape of the network, which networks of the
+// same run share.
+func (i *Info) Architecture() string {
+	parts := []string{}
+	if i.EncoderLayers > 0 {
+		parts = append(parts, fmt.Sprintf("%d encoder layers", i.EncoderLayers))
+	} else {
+		parts = append(parts, fmt.Sprintf("%dx%d", i.Blocks, i.Filters))
+	}
+	parts = append(parts,
+		"network="+i.Network,
+		"policy="+i.Policy,
+		"value="+i.Value,
+		"moves_left="+i.MovesLeft,
+		"input="+i.Input)
+	return strings.Join(parts, " ")
+}
+
+// String returns a one line summary of the network.
+func (i *Info) String() string {
+	parts := []string{i.Architecture()}
+	if i.MinVersion != "" {
+		parts = append(parts, "min_version="+i.MinVersion)
+	}
+	if i.Training != nil && i.Training.TrainingSteps > 0 {
+		parts = append(parts, fmt.Sprintf("steps=%d", i.Training.TrainingSteps))
+	}
+	return strings.Join(parts, " ")
+}
+
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errTruncated = errors.New("truncated protobuf")
+
+// walk calls fn for every field in a protobuf message. Fixed size and varint
+// values are passed in v, length delimited values in b.
+func walk(data []byte, fn func(num int, wire int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+		num := int(key >> 3)
+		wire := int(key & 7)
+		var v uint64
+		var b []byte
+		switch wire {
+		case wireVarint:
+			v, n = binary.Uvarint(data)
+			if n <= 0 {
+				return errTruncated
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errTruncated
+			}
+			v = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case wireBytes:
+			l, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < l {
+				return errTruncated
+			}
+			b = data[n : n+int(l)]
+			data = data[n+int(l):]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errTruncated
+			}
+			v = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", wire)
+		}
+		if err := fn(num, wire, v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package netinfo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Protobuf encoding helpers.
+
+func uvarint(v uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutUvarint(b, v)]
+}
+
+func key(num int, wire int) []byte {
+	return uvarint(uint64(num<<3 | wire))
+}
+
+func varint(num int, v uint64) []byte {
+	return append(key(num, wireVarint), uvarint(v)...)
+}
+
+func fixed32(num int, v uint32) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, v)
+	return append(key(num, wireFixed32), b...)
+}
+
+func fixed64(num int, v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return append(key(num, wireFixed64), b...)
+}
+
+func message(num int, fields ...[]byte) []byte {
+	body := bytes.Join(fields, nil)
+	return append(append(key(num, wireBytes), uvarint(uint64(len(body)))...), body...)
+}
+
+func text(num int, s string) []byte {
+	return message(num, []byte(s))
+}
+
+// network encodes a net with blocks residual blocks of filters filters.
+func network(blocks int, filters int, extra ...[]byte) []byte {
+	// A linear16 bias layer of the input convolution.
+	input := message(1, message(2, message(3, make([]byte, 2*filters)), varint(4, 1)))
+	weights := [][]byte{input}
+	for i := 0; i < blocks; i++ {
+		weights = append(weights, message(2))
+	}
+	fields := [][]byte{
+		fixed32(1, netMagic),
+		text(2, "AGPLv3"),
+		message(3, varint(1, 0), varint(2, 30), varint(3, 0)),
+		message(4, varint(1, 1), message(2, varint(1, 3), varint(2, 2), varint(3, 4), varint(4, 2), varint(5, 2), varint(6, 1))),
+		message(5, varint(1, 12345), fixed32(2, 0), text(6, "--cpuct=1.7")),
+		message(10, weights...),
+	}
+	return bytes.Join(append(fields, extra...), nil)
+}
+
+func TestParse(t *testing.T) {
+	full := network(10, 128)
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr string
+	}{
+		{
+			name: "header",
+			data: full,
+			want: "10x128 network=se-with-headformat policy=convolution value=wdl moves_left=v1 input=112-with-canonicalization min_version=v0.30.0 steps=12345",
+		},
+		{
+			name: "unknown fields",
+			data: network(6, 64, varint(99, 7), fixed64(98, 1), text(97, "future"),
+				message(4, message(2, varint(7, 1), varint(3, 200)))),
+			want: "6x64 network=unknown(200) policy=convolution value=wdl moves_left=v1 input=112-with-canonicalization min_version=v0.30.0 steps=12345",
+		},
+		{
+			name: "encoder",
+			data: bytes.Join([][]byte{fixed32(1, netMagic), message(10, message(27), message(27))}, nil),
+			want: "2 encoder layers network=unknown policy=unknown value=unknown moves_left=none input=unknown",
+		},
+		{name: "truncated message", data: full[:len(full)-5], wantErr: "truncated"},
+		{name: "truncated key", data: append(fixed32(1, netMagic), 0x80), wantErr: "truncated"},
+		{name: "truncated fixed32", data: fixed32(1, netMagic)[:3], wantErr: "truncated"},
+		{name: "unsupported wire type", data: append(fixed32(1, netMagic), key(7, 3)...), wantErr: "wire type 3"},
+		{name: "unknown layer encoding", data: append(fixed32(1, netMagic),
+			message(10, message(1, message(2, message(3, make([]byte, 8)), varint(4, 9))))...), wantErr: "layer encoding 9"},
+		{name: "not a network", data: text(2, "hello"), wantErr: "not an lc0 network"},
+		{name: "empty", data: nil, wantErr: "not an lc0 network"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := Parse(tt.data)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Parse() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Parse() = %v", err)
+			}
+			if got := info.String(); got != tt.want {
+				t.Errorf("Parse() = %s\n want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func writeNetwork(t *testing.T, path string, data []byte) {
+	var buf bytes.Buffer
+	z := gzip.NewWriter(&buf)
+	z.Write(data)
+	z.Close()
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "net.pb.gz")
+
+	writeNetwork(t, path, network(10, 128))
+	first, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := ReadFile(path); err != nil || again != first {
+		t.Errorf("ReadFile() of an unchanged network = %p, %v, want the cached %p", again, err, first)
+	}
+
+	writeNetwork(t, path, network(20, 256))
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path, later, later)
+	changed, err := ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed.Blocks != 20 || changed.Filters != 256 {
+		t.Errorf("ReadFile() of a changed network = %s, want 20x256", changed.Architecture())
+	}
+
+	ioutil.WriteFile(path, []byte("not gzip"), 0644)
+	if _, err := ReadFile(path); err == nil {
+		t.Error("ReadFile() of a file that is not gzip compressed succeeded")
+	}
+}
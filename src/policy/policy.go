@@ -0,0 +1,251 @@
+// Package policy picks lc0 settings by rules in a JSON file, so that one
+// file can configure clients on different hardware.
+//
+// A policy file looks like
+//
+//	{"Rules": [
+//	  {"Name": "old cards", "Gpu": "GTX 10[0-9]0", "Backend": "cuda-auto", "Parallelism": 16},
+//	  {"Name": "big nets", "Architecture": "encoder", "Lc0Version": ">=0.31",
+//	   "BackendOpts": "max_batch=512", "Lc0Flags": ["--nncache=2000000"]}
+//	]}
+//
+// Gpu and Architecture are regular expressions, OS is matched exactly and
+// Lc0Version is a comma separated list of comparisons. Versions compare as in
+// the minimum version checks of package lc0version: missing parts are 0, and
+// release candidates and development builds come before their release, so
+// >=0.32 does not match v0.32.0-rc1. Empty conditions match anything. The first rule matching wins. The file is read again when
+// it changes.
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LeelaChessZero/lczero-client/src/backendopts"
+	"github.com/LeelaChessZero/lczero-client/src/lc0version"
+	"github.com/LeelaChessZero/lczero-client/src/logging"
+)
+
+// Rule sets lc0 settings for the launches it matches.
+type Rule struct {
+	Name string
+	// Conditions.
+	Gpu          string
+	Lc0Version   string
+	Architecture string
+	OS           string
+	// Settings, unset ones keep the client's defaults.
+	Backend     string
+	BackendOpts string
+	Parallelism int
+	Lc0Flags    []string
+
+	gpu          *regexp.Regexp
+	architecture *regexp.Regexp
+	versions     []constraint
+}
+
+// Facts describe an lc0 launch for matching rules.
+type Facts struct {
+	// The device lc0 reports, empty if unknown.
+	Gpu          string
+	Lc0Version   string
+	Architecture string
+	OS           string
+}
+
+type constraint struct {
+	op      string
+	version lc0version.Version
+}
+
+var policyLog = logging.New("policy")
+
+func parseConstraints(s string) ([]constraint, error) {
+	var cs []constraint
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		op := "="
+		for _, o := range []string{">=", "<=", "!=", ">", "<", "="} {
+			if strings.HasPrefix(part, o) {
+				op = o
+				part = part[len(o):]
+				break
+			}
+		}
+		v, err := lc0version.Parse(part)
+		if err != nil {
+			return nil, err
+		}
+		cs = append(cs, constraint{op: op, version: v})
+	}
+	return cs, nil
+}
+
+func (c constraint) match(version lc0version.Version) bool {
+	cmp := version.Compare(c.version)
+	switch c.op {
+	case ">=":
+		return cmp >= 0
+	case "<=":
+		return cmp <= 0
+	case "!=":
+		return cmp != 0
+	case ">":
+		return cmp > 0
+	case "<":
+		return cmp < 0
+	}
+	return cmp == 0
+}
+
+func (r *Rule) compile() error {
+	var err error
+	if r.Gpu != "" {
+		if r.gpu, err = regexp.Compile(r.Gpu); err != nil {
+			return err
+		}
+	}
+	if r.Architecture != "" {
+		if r.architecture, err = regexp.Compile(r.Architecture); err != nil {
+			return err
+		}
+	}
+	r.versions, err = parseConstraints(r.Lc0Version)
+	if err != nil {
+		return err
+	}
+	if r.Backend != "" && r.Backend != "default" && !backendopts.AllowedBackend(r.Backend) {
+		return fmt.Errorf("backend %q is not allowed", r.Backend)
+	}
+	if r.BackendOpts != "" {
+		if _, err := backendopts.Validate(r.BackendOpts); err != nil {
+			return fmt.Errorf("invalid backend options, %v", err)
+		}
+	}
+	if err := backendopts.CheckFlags(r.Lc0Flags); err != nil {
+		return fmt.Errorf("%v, use Backend and BackendOpts", err)
+	}
+	if r.Parallelism < 0 {
+		return fmt.Errorf("parallelism %d is negative", r.Parallelism)
+	}
+	return nil
+}
+
+// Matches reports whether the rule applies to f.
+func (r *Rule) Matches(f Facts) bool {
+	if r.gpu != nil && !r.gpu.MatchString(f.Gpu) {
+		return false
+	}
+	if r.architecture != nil && !r.architecture.MatchString(f.Architecture) {
+		return false
+	}
+	if r.OS != "" && r.OS != f.OS {
+		return false
+	}
+	if len(r.versions) > 0 {
+		v, err := lc0version.Parse(f.Lc0Version)
+		if err != nil {
+			return false
+		}
+		for _, c := range r.versions {
+			if !c.match(v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Policy is a list of rules.
+type Policy struct {
+	Rules []*Rule
+}
+
+// Parse reads a policy from JSON.
+func Parse(b []byte) (*Policy, error) {
+	p := &Policy{}
+	if err := json.Unmarshal(b, p); err != nil {
+		return nil, err
+	}
+	for i, r := range p.Rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule %d", i+1)
+		}
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("%s: %v", r.Name, err)
+		}
+	}
+	return p, nil
+}
+
+// Evaluate returns the first rule matching f, or nil.
+func (p *Policy) Evaluate(f Facts) *Rule {
+	for _, r := range p.Rules {
+		if r.Matches(f) {
+			return r
+		}
+	}
+	return nil
+}
+
+// File is a policy file, read again when it changes.
+type File struct {
+	path    string
+	mutex   sync.Mutex
+	modTime time.Time
+	policy  *Policy
+}
+
+// Open reads the policy file at path.
+func Open(path string) (*File, error) {
+	f := &File{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) reload() error {
+	fi, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if f.policy != nil && fi.ModTime().Equal(f.modTime) {
+		return nil
+	}
+	b, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	p, err := Parse(b)
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.path, err)
+	}
+	if f.policy != nil {
+		policyLog.Infof("Reloaded %s", f.path)
+	}
+	f.policy = p
+	f.modTime = fi.ModTime()
+	return nil
+}
+
+// Evaluate returns the first rule matching facts, or nil. If the file
+// changed but cannot be read, the previous rules stay in effect.
+func (f *File) Evaluate(facts Facts) *Rule {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.reload(); err != nil {
+		policyLog.Warnf("Keeping the previous policy: %v", err)
+	}
+	return f.policy.Evaluate(facts)
+}
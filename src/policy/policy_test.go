@@ -0,0 +1,81 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+)
+
+const example = `{"Rules": [
+  {"Name": "old cards", "Gpu": "GTX 10[0-9]0", "Backend": "cuda-auto", "Parallelism": 16},
+  {"Name": "big nets", "Architecture": "encoder", "Lc0Version": ">=0.31, <0.33",
+   "BackendOpts": "max_batch=512", "Lc0Flags": ["--nncache=2000000"]},
+  {"Name": "windows", "OS": "windows", "Backend": "dx12"},
+  {"Lc0Version": "0.30"}
+]}`
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		wantErr string
+	}{
+		{"example", example, ""},
+		{"empty", `{}`, ""},
+		{"not json", `{"Rules": [`, "unexpected end"},
+		{"bad gpu", `{"Rules": [{"Gpu": "("}]}`, "rule 1: error parsing regexp"},
+		{"bad architecture", `{"Rules": [{"Name": "a", "Architecture": "["}]}`, "a: error parsing regexp"},
+		{"bad version", `{"Rules": [{"Lc0Version": ">=latest"}]}`, `"latest" is not an lc0 version`},
+		{"backend", `{"Rules": [{"Backend": "random"}]}`, `backend "random" is not allowed`},
+		{"default backend", `{"Rules": [{"Backend": "default"}]}`, ""},
+		{"backend opts", `{"Rules": [{"BackendOpts": "trivial"}]}`, "invalid backend options"},
+		{"backend flag", `{"Rules": [{"Lc0Flags": ["--backend=random"]}]}`, "use Backend and BackendOpts"},
+		{"weights flag", `{"Rules": [{"Lc0Flags": ["-w", "net.pb.gz"]}]}`, "is not allowed"},
+		{"parallelism", `{"Rules": [{"Parallelism": -1}]}`, "negative"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.json))
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Parse() = %v, want no error", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Parse() = %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	p, err := Parse([]byte(example))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		facts Facts
+		want  string
+	}{
+		{"gpu", Facts{Gpu: "NVIDIA GeForce GTX 1080", Lc0Version: "v0.31.2", Architecture: "encoder"}, "old cards"},
+		{"architecture and version", Facts{Gpu: "RTX 4090", Lc0Version: "v0.31.2", Architecture: "encoder"}, "big nets"},
+		{"release candidate", Facts{Lc0Version: "v0.32.0-rc1", Architecture: "encoder"}, "big nets"},
+		{"version too new", Facts{Lc0Version: "v0.33.0", Architecture: "encoder", OS: "windows"}, "windows"},
+		{"unknown version", Facts{Architecture: "encoder", OS: "linux"}, ""},
+		{"candidate of the next release", Facts{Lc0Version: "v0.33.0-rc1", Architecture: "encoder"}, "big nets"},
+		{"candidate of the first release", Facts{Lc0Version: "v0.31.0-rc2", Architecture: "encoder", OS: "linux"}, ""},
+		{"development build", Facts{Lc0Version: "v0.32.0-dev+git.abc1234", Architecture: "encoder"}, "big nets"},
+		{"exact version", Facts{Lc0Version: "v0.30.0", OS: "linux"}, "rule 4"},
+		{"other patch version", Facts{Lc0Version: "v0.30.1", OS: "linux"}, ""},
+		{"no match", Facts{Lc0Version: "v0.29.0", OS: "linux"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ""
+			if r := p.Evaluate(tt.facts); r != nil {
+				got = r.Name
+			}
+			if got != tt.want {
+				t.Errorf("Evaluate(%+v) = %q, want %q", tt.facts, got, tt.want)
+			}
+		})
+	}
+}
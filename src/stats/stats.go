@@ -0,0 +1,163 @@
+// Package stats keeps lifetime contribution statistics in a JSON file, so
+// they survive client restarts. Clients sharing the file take turns through
+// a lock file.
+package stats
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gofrs/flock"
+)
+
+// Record counts the games played on one day for one combination of game
+// type, training run, network and lc0 version.
+type Record struct {
+	Day        string
+	Type       string
+	Run        uint
+	Network    uint
+	Lc0Version string
+	Games      int
+	// Match results from the candidate's point of view.
+	Wins   int
+	Losses int
+	Draws  int
+}
+
+func (r *Record) sameKey(o *Record) bool {
+	return r.Day == o.Day && r.Type == o.Type && r.Run == o.Run && r.Network == o.Network && r.Lc0Version == o.Lc0Version
+}
+
+// Store is a stats file.
+type Store struct {
+	path string
+}
+
+// Open returns the store kept at path, which is created on the first Add.
+func Open(path string) *Store {
+	return &Store{path: path}
+}
+
+// Day returns the day t falls on, as used in records.
+func Day(t time.Time) string {
+	return t.Format("2006-01-02")
+}
+
+func (s *Store) read() ([]Record, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []Record
+	err = json.Unmarshal(b, &records)
+	return records, err
+}
+
+// Load returns all records.
+func (s *Store) Load() ([]Record, error) {
+	lock := flock.New(s.path + ".lck")
+	if err := lock.RLock(); err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	return s.read()
+}
+
+// Add merges r into the record with the same key, or appends it.
+func (s *Store) Add(r Record) error {
+	lock := flock.New(s.path + ".lck")
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	records, err := s.read()
+	if err != nil {
+		return err
+	}
+	found := false
+	for i := range records {
+		if records[i].sameKey(&r) {
+			records[i].Games += r.Games
+			records[i].Wins += r.Wins
+			records[i].Losses += r.Losses
+			records[i].Draws += r.Draws
+			found = true
+			break
+		}
+	}
+	if !found {
+		records = append(records, r)
+	}
+	b, err := json.MarshalIndent(records, "", " ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash cannot truncate the stats.
+	tmp := s.path + "_tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Summary is the sum of a group of records.
+type Summary struct {
+	Key    string
+	Games  int
+	Wins   int
+	Losses int
+	Draws  int
+}
+
+// Summarize sums the records grouped by key, sorted by key.
+func Summarize(records []Record, key func(r Record) string) []Summary {
+	byKey := map[string]*Summary{}
+	for _, r := range records {
+		k := key(r)
+		s, ok := byKey[k]
+		if !ok {
+			s = &Summary{Key: k}
+			byKey[k] = s
+		}
+		s.Games += r.Games
+		s.Wins += r.Wins
+		s.Losses += r.Losses
+		s.Draws += r.Draws
+	}
+	var result []Summary
+	for _, s := range byKey {
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
+
+// WriteCSV writes the records as CSV with a header line.
+func WriteCSV(w io.Writer, records []Record) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"day", "type", "run", "network", "lc0_version", "games", "wins", "losses", "draws"})
+	for _, r := range records {
+		cw.Write([]string{
+			r.Day, r.Type,
+			strconv.FormatUint(uint64(r.Run), 10),
+			strconv.FormatUint(uint64(r.Network), 10),
+			r.Lc0Version,
+			strconv.Itoa(r.Games),
+			strconv.Itoa(r.Wins),
+			strconv.Itoa(r.Losses),
+			strconv.Itoa(r.Draws),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,150 @@
+package stats
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func tempStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Open(filepath.Join(dir, "stats.json")), func() { os.RemoveAll(dir) }
+}
+
+func TestAdd(t *testing.T) {
+	s, cleanup := tempStore(t)
+	defer cleanup()
+	if records, err := s.Load(); err != nil || records != nil {
+		t.Fatalf("Load() of a missing file = %v, %v, want nothing", records, err)
+	}
+	adds := []Record{
+		{Day: "2026-10-17", Type: "train", Run: 1, Network: 700, Lc0Version: "v0.31.2", Games: 3},
+		{Day: "2026-10-17", Type: "train", Run: 1, Network: 700, Lc0Version: "v0.31.2", Games: 2},
+		{Day: "2026-10-17", Type: "train", Run: 1, Network: 701, Lc0Version: "v0.31.2", Games: 1},
+		{Day: "2026-10-18", Type: "match", Run: 1, Network: 701, Lc0Version: "v0.31.2", Games: 1, Wins: 1},
+		{Day: "2026-10-18", Type: "match", Run: 1, Network: 701, Lc0Version: "v0.31.2", Games: 2, Losses: 1, Draws: 1},
+		{Day: "2026-10-18", Type: "match", Run: 1, Network: 701, Lc0Version: "v0.32.0", Games: 1, Draws: 1},
+	}
+	for _, r := range adds {
+		if err := s.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []Record{
+		{Day: "2026-10-17", Type: "train", Run: 1, Network: 700, Lc0Version: "v0.31.2", Games: 5},
+		{Day: "2026-10-17", Type: "train", Run: 1, Network: 701, Lc0Version: "v0.31.2", Games: 1},
+		{Day: "2026-10-18", Type: "match", Run: 1, Network: 701, Lc0Version: "v0.31.2", Games: 3, Wins: 1, Losses: 1, Draws: 1},
+		{Day: "2026-10-18", Type: "match", Run: 1, Network: 701, Lc0Version: "v0.32.0", Games: 1, Draws: 1},
+	}
+	// A new store reads what the first one wrote.
+	records, err := Open(s.path).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != len(want) {
+		t.Fatalf("Load() = %+v, want %+v", records, want)
+	}
+	for i := range want {
+		if records[i] != want[i] {
+			t.Errorf("record %d = %+v, want %+v", i, records[i], want[i])
+		}
+	}
+}
+
+func TestAddConcurrently(t *testing.T) {
+	s, cleanup := tempStore(t)
+	defer cleanup()
+	const clients, games = 3, 10
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			// Each client opens the file on its own, as separate processes do.
+			store := Open(s.path)
+			for i := 0; i < games; i++ {
+				if err := store.Add(Record{Day: "2026-10-18", Type: "train", Run: uint(c % 2), Games: 1}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+	records, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, r := range records {
+		total += r.Games
+	}
+	if len(records) != 2 || total != clients*games {
+		t.Errorf("Load() = %+v, want 2 records with %d games", records, clients*games)
+	}
+}
+
+func TestLoadCorrupt(t *testing.T) {
+	s, cleanup := tempStore(t)
+	defer cleanup()
+	ioutil.WriteFile(s.path, []byte("[{"), 0644)
+	if _, err := s.Load(); err == nil {
+		t.Error("Load() of a corrupt file succeeded")
+	}
+	if err := s.Add(Record{Games: 1}); err == nil {
+		t.Error("Add() to a corrupt file succeeded, losing its records")
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	records := []Record{
+		{Day: "2026-10-18", Network: 701, Games: 2, Wins: 1},
+		{Day: "2026-10-17", Network: 700, Games: 5},
+		{Day: "2026-10-18", Network: 700, Games: 1, Draws: 1},
+	}
+	tests := []struct {
+		name string
+		key  func(r Record) string
+		want []Summary
+	}{
+		{"by day", func(r Record) string { return r.Day }, []Summary{
+			{Key: "2026-10-17", Games: 5},
+			{Key: "2026-10-18", Games: 3, Wins: 1, Draws: 1},
+		}},
+		{"total", func(r Record) string { return "all" }, []Summary{
+			{Key: "all", Games: 8, Wins: 1, Draws: 1},
+		}},
+	}
+	for _, tt := range tests {
+		got := Summarize(records, tt.key)
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: Summarize() = %+v, want %+v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: Summarize()[%d] = %+v, want %+v", tt.name, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteCSV(&buf, []Record{{Day: Day(time.Date(2026, 10, 18, 23, 0, 0, 0, time.UTC)), Type: "match", Run: 1,
+		Network: 701, Lc0Version: "v0.31.2", Games: 3, Wins: 1, Losses: 1, Draws: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "day,type,run,network,lc0_version,games,wins,losses,draws\n2026-10-18,match,1,701,v0.31.2,3,1,1,1\n"
+	if buf.String() != want {
+		t.Errorf("WriteCSV() = %q, want %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,220 @@
+// Package status tracks what the client is doing and serves it as JSON and
+// as a small HTML dashboard.
+package status
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How many finished games are kept for the dashboard.
+const recentGamesLimit = 20
+
+// Game is a recently finished game.
+type Game struct {
+	Time   time.Time
+	Type   string
+	Result string
+	Pgn    string
+}
+
+// Worker is the state of one GPU, when the client runs games on several.
+type Worker struct {
+	Gpu       int
+	Device    string
+	Backend   string
+	Task      string
+	NetworkId uint
+	Games     int
+	LastError string
+}
+
+// Status is a snapshot of the client state.
+type Status struct {
+	StartTime       time.Time
+	Task            string
+	RunId           uint
+	NetworkId       uint
+	NetworkSha      string
+	CandidateSha    string
+	Network         string
+	Lc0Version      string
+	Backend         string
+	Gpu             string
+	GamesSinceStart int
+	PendingUploads  int
+	LastError       string
+	LastErrorTime   time.Time
+	SelfCheck       string
+	SelfCheckTime   time.Time
+	SpotCheck       string
+	SpotCheckTime   time.Time
+	RecentGames     []Game
+	Workers         []Worker
+}
+
+var (
+	mutex   sync.Mutex
+	current = Status{StartTime: time.Now()}
+)
+
+// Update calls fn with the current status to modify it.
+func Update(fn func(s *Status)) {
+	mutex.Lock()
+	fn(&current)
+	mutex.Unlock()
+}
+
+// Get returns a copy of the current status.
+func Get() Status {
+	mutex.Lock()
+	defer mutex.Unlock()
+	s := current
+	s.RecentGames = append([]Game(nil), current.RecentGames...)
+	s.Workers = append([]Worker(nil), current.Workers...)
+	return s
+}
+
+// UpdateWorker calls fn with the state of the worker for gpu to modify it,
+// adding the worker if needed.
+func UpdateWorker(gpu int, fn func(w *Worker)) {
+	Update(func(s *Status) {
+		for i := range s.Workers {
+			if s.Workers[i].Gpu == gpu {
+				fn(&s.Workers[i])
+				return
+			}
+		}
+		s.Workers = append(s.Workers, Worker{Gpu: gpu})
+		sort.Slice(s.Workers, func(i, j int) bool { return s.Workers[i].Gpu < s.Workers[j].Gpu })
+		for i := range s.Workers {
+			if s.Workers[i].Gpu == gpu {
+				fn(&s.Workers[i])
+			}
+		}
+	})
+}
+
+// AddGame records a finished game.
+func AddGame(gameType string, result string, pgn string) {
+	Update(func(s *Status) {
+		s.RecentGames = append(s.RecentGames, Game{Time: time.Now(), Type: gameType, Result: result, Pgn: pgn})
+		if len(s.RecentGames) > recentGamesLimit {
+			s.RecentGames = s.RecentGames[len(s.RecentGames)-recentGamesLimit:]
+		}
+	})
+}
+
+// SetError records the last error the client ran into.
+func SetError(err error) {
+	Update(func(s *Status) {
+		s.LastError = err.Error()
+		s.LastErrorTime = time.Now()
+	})
+}
+
+// Handler serves the status as JSON.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(Get())
+	})
+}
+
+// PageHandler serves the dashboard, which polls the JSON status at
+// statusPath.
+func PageHandler(statusPath string) http.Handler {
+	page := []byte(pageTemplate[0] + statusPath + pageTemplate[1])
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+	})
+}
+
+var pageTemplate = [2]string{`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Lc0 training client</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+pre { white-space: pre-wrap; margin: 0; font-size: 0.85em; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Lc0 training client</h1>
+<table id="status"></table>
+<div id="workers"></div>
+<h2>Recent games</h2>
+<table id="games"></table>
+<script>
+function row(cells, header) {
+  var tr = document.createElement("tr");
+  cells.forEach(function(c) {
+    var td = document.createElement(header ? "th" : "td");
+    if (c instanceof Node) { td.appendChild(c); } else { td.textContent = c; }
+    tr.appendChild(td);
+  });
+  return tr;
+}
+function refresh() {
+  fetch("`, `").then(function(r) { return r.json(); }).then(function(s) {
+    var status = document.getElementById("status");
+    status.innerHTML = "";
+    [["Task", s.Task], ["Run", s.RunId], ["Network", s.NetworkId + " " + s.NetworkSha],
+     ["Architecture", s.Network], ["Candidate", s.CandidateSha], ["Lc0 version", s.Lc0Version],
+     ["Backend", s.Backend], ["GPU", s.Gpu], ["Started", s.StartTime],
+     ["Games since start", s.GamesSinceStart], ["Pending uploads", s.PendingUploads],
+     ["Last error", s.LastError ? s.LastErrorTime + ": " + s.LastError : ""],
+     ["Self check", s.SelfCheck ? s.SelfCheckTime + ": " + s.SelfCheck : ""],
+     ["Spot check", s.SpotCheck ? s.SpotCheckTime + ": " + s.SpotCheck : ""]
+    ].forEach(function(r) {
+      var tr = row(r);
+      if (r[0] == "Last error" && r[1]) { tr.className = "error"; }
+      if (r[0] == "Self check" && / failed/.test(r[1])) { tr.className = "error"; }
+      if (r[0] == "Spot check" && /: failed/.test(r[1])) { tr.className = "error"; }
+      status.appendChild(tr);
+    });
+    var workers = document.getElementById("workers");
+    workers.innerHTML = "";
+    if (s.Workers && s.Workers.length > 0) {
+      var h = document.createElement("h2");
+      h.textContent = "GPUs";
+      workers.appendChild(h);
+      var table = document.createElement("table");
+      table.appendChild(row(["GPU", "Device", "Backend", "Task", "Network", "Games", "Last error"], true));
+      s.Workers.forEach(function(w) {
+        var tr = row([w.Gpu, w.Device, w.Backend, w.Task, w.NetworkId, w.Games, w.LastError]);
+        if (w.LastError) { tr.className = "error"; }
+        table.appendChild(tr);
+      });
+      workers.appendChild(table);
+    }
+    var games = document.getElementById("games");
+    games.innerHTML = "";
+    games.appendChild(row(["Time", "Type", "Result", "PGN"], true));
+    (s.RecentGames || []).slice().reverse().forEach(function(g) {
+      var pre = document.createElement("pre");
+      pre.textContent = g.Pgn;
+      games.appendChild(row([g.Time, g.Type, g.Result, pre]));
+    });
+  });
+}
+refresh();
+setInterval(refresh, 10000);
+</script>
+</body>
+</html>
+`}
@@ -0,0 +1,46 @@
+// Package sysinfo reports free disk space and available memory.
+package sysinfo
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// ErrUnsupported is returned when a value cannot be determined on this
+// platform.
+var ErrUnsupported = errors.New("not supported on " + runtime.GOOS)
+
+// AvailableMemory returns the memory in bytes available for starting new
+// applications without swapping. Only Linux is supported.
+func AvailableMemory() (uint64, error) {
+	if runtime.GOOS != "linux" {
+		return 0, ErrUnsupported
+	}
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// The line looks like "MemAvailable:    1234567 kB".
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return kb * 1024, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	// Kernels before 3.14 do not report it.
+	return 0, ErrUnsupported
+}
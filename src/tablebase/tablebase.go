@@ -0,0 +1,205 @@
+// Package tablebase keeps a local directory of Syzygy tablebases in sync with
+// a manifest of file checksums.
+//
+// The manifest uses the sha256sum output format, one "<sha256>  <file>" line
+// per tablebase file.
+package tablebase
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/LeelaChessZero/lczero-client/src/client"
+	"github.com/LeelaChessZero/lczero-client/src/logging"
+)
+
+var cacheLog = logging.New("cache")
+
+// File is a tablebase file listed in the manifest.
+type File struct {
+	Name string
+	Sha  string
+}
+
+// Name of the file recording which files were already verified.
+const verifiedName = "verified.json"
+
+var fileRegex = regexp.MustCompile(`^K[QRBNP]*vK[QRBNP]*\.rtb[wz]$`)
+var shaRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// Pieces returns the number of pieces of a tablebase file, e.g. 3 for
+// KQvK.rtbw.
+func Pieces(name string) int {
+	return len(strings.Replace(strings.Split(name, ".")[0], "v", "", 1))
+}
+
+// ParseManifest reads a manifest, keeping only the files with at most
+// maxPieces pieces.
+func ParseManifest(r io.Reader, maxPieces int) ([]File, error) {
+	var files []File
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed manifest line %q", line)
+		}
+		// sha256sum marks binary mode files with a '*'.
+		name := strings.TrimPrefix(fields[1], "*")
+		sha := strings.ToLower(fields[0])
+		if !fileRegex.MatchString(name) || !shaRegex.MatchString(sha) {
+			return nil, fmt.Errorf("malformed manifest line %q", line)
+		}
+		if Pieces(name) <= maxPieces {
+			files = append(files, File{Name: name, Sha: sha})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.New("manifest lists no usable tablebase files")
+	}
+	return files, nil
+}
+
+// ReadManifest loads the manifest from a local path or an http(s) url.
+func ReadManifest(httpClient *http.Client, location string, maxPieces int) ([]File, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		resp, err := httpClient.Get(location)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 400 {
+			resp.Body.Close()
+			return nil, errors.New("Manifest server gave error status: " + resp.Status)
+		}
+		r = resp.Body
+	} else {
+		file, err := os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		r = file
+	}
+	defer r.Close()
+	return ParseManifest(r, maxPieces)
+}
+
+// verifiedEntry records the state of a file when its checksum was verified,
+// so unchanged files are not hashed again on every start.
+type verifiedEntry struct {
+	Sha     string
+	Size    int64
+	ModTime int64
+}
+
+func readVerified(dir string) map[string]verifiedEntry {
+	verified := map[string]verifiedEntry{}
+	b, err := ioutil.ReadFile(filepath.Join(dir, verifiedName))
+	if err == nil {
+		json.Unmarshal(b, &verified)
+	}
+	return verified
+}
+
+func writeVerified(dir string, verified map[string]verifiedEntry) error {
+	b, err := json.Marshal(verified)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, verifiedName), b, 0644)
+}
+
+func fileSha(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sum.Sum(nil)), nil
+}
+
+// check verifies a single file, deleting it if its checksum is wrong.
+func check(dir string, f File, verified map[string]verifiedEntry) bool {
+	path := filepath.Join(dir, f.Name)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	entry, ok := verified[f.Name]
+	if ok && entry.Sha == f.Sha && entry.Size == fi.Size() && entry.ModTime == fi.ModTime().UnixNano() {
+		return true
+	}
+	got, err := fileSha(path)
+	if err != nil || got != f.Sha {
+		cacheLog.Warnf("Deleting invalid tablebase file %s", f.Name)
+		os.Remove(path)
+		delete(verified, f.Name)
+		return false
+	}
+	verified[f.Name] = verifiedEntry{Sha: f.Sha, Size: fi.Size(), ModTime: fi.ModTime().UnixNano()}
+	return true
+}
+
+// Sync makes sure dir holds a verified copy of every file, downloading the
+// missing ones from the mirrors (tried in order). Interrupted downloads are
+// resumed.
+func Sync(httpClient *http.Client, dir string, files []File, mirrors []string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	verified := readVerified(dir)
+	defer writeVerified(dir, verified)
+	var missing []File
+	for _, f := range files {
+		if !check(dir, f, verified) {
+			missing = append(missing, f)
+		}
+	}
+	if len(missing) > 0 && len(mirrors) == 0 {
+		return errors.New("tablebase files are missing and no mirror is configured")
+	}
+	if len(missing) > 0 {
+		cacheLog.Infof("Downloading %d of %d tablebase files", len(missing), len(files))
+	}
+	for i, f := range missing {
+		var err error
+		for _, mirror := range mirrors {
+			if !strings.HasSuffix(mirror, "/") {
+				mirror += "/"
+			}
+			err = client.DownloadFile(httpClient, mirror+f.Name, filepath.Join(dir, f.Name))
+			if err == nil {
+				if check(dir, f, verified) {
+					break
+				}
+				err = fmt.Errorf("checksum mismatch for %s from %s", f.Name, mirror)
+			}
+			cacheLog.Warnf("Tablebase download failed: %v", err)
+		}
+		if err != nil {
+			return err
+		}
+		cacheLog.Infof("Downloaded tablebase file %s (%d/%d)", f.Name, i+1, len(missing))
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// Package trainingdata reads the training files lc0 writes during selfplay.
+//
+// A file is a gzip compressed sequence of fixed size records, one per
+// position of a game, in the order they were played (see trainingdata.h in
+// the lc0 repository). Only version 6 records are supported, older lc0
+// versions write formats without the raw network evaluation.
+package trainingdata
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math/bits"
+	"os"
+)
+
+// The number of moves in the policy head.
+const PolicySize = 1858
+
+// RecordSize is the size of a version 6 record.
+const RecordSize = 8356
+
+// Record is a version 6 training record. Values are from the point of view
+// of the side to move.
+type Record struct {
+	Version     uint32
+	InputFormat uint32
+	// Visit distribution of the search, by policy index. Illegal moves are
+	// -1.
+	Probabilities [PolicySize]float32
+	// Input planes, 13 for each of the last 8 positions.
+	Planes         [104]uint64
+	CastlingUsOOO  uint8
+	CastlingUsOO   uint8
+	CastlingThOOO  uint8
+	CastlingThOO   uint8
+	SideToMove     uint8
+	Rule50Count    uint8
+	InvarianceInfo uint8
+	Dummy          uint8
+	RootQ          float32
+	BestQ          float32
+	RootD          float32
+	BestD          float32
+	RootM          float32
+	BestM          float32
+	PliesLeft      float32
+	ResultQ        float32
+	ResultD        float32
+	PlayedQ        float32
+	PlayedD        float32
+	PlayedM        float32
+	// The raw network evaluation, NaN if it was not in the cache.
+	OrigQ     float32
+	OrigD     float32
+	OrigM     float32
+	Visits    uint32
+	PlayedIdx uint16
+	BestIdx   uint16
+	// Kullback-Leibler divergence of the network policy from the visits.
+	PolicyKLD float32
+	Reserved  uint32
+}
+
+// Read returns the records of the training file at path.
+func Read(path string) ([]*Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	z, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(z)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) >= 4 {
+		if v := binary.LittleEndian.Uint32(b); v != 6 {
+			return nil, fmt.Errorf("training data version %d is not supported", v)
+		}
+	}
+	if len(b)%RecordSize != 0 {
+		return nil, fmt.Errorf("%d bytes is not a whole number of records", len(b))
+	}
+	r := bytes.NewReader(b)
+	var records []*Record
+	for r.Len() > 0 {
+		rec := &Record{}
+		if err := binary.Read(r, binary.LittleEndian, rec); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, nil
+}
+
+// Pieces returns the number of pieces on the board, which unlike the planes
+// does not depend on the transform applied to the position.
+func (r *Record) Pieces() int {
+	n := 0
+	for _, p := range r.Planes[:12] {
+		n += bits.OnesCount64(p)
+	}
+	return n
+}
+
+// Transform returns the symmetry lc0 applied to the planes and policy, 0
+// for none. Only the canonical input formats use them.
+func (r *Record) Transform() int {
+	if r.InputFormat < 3 {
+		return 0
+	}
+	return int(r.InvarianceInfo & 7)
+}
@@ -0,0 +1,129 @@
+package trainingdata
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeFile writes data gzip compressed to a file in dir.
+func writeFile(t *testing.T, dir string, name string, data []byte) string {
+	var buf bytes.Buffer
+	z := gzip.NewWriter(&buf)
+	z.Write(data)
+	z.Close()
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func encode(t *testing.T, records ...*Record) []byte {
+	var buf bytes.Buffer
+	for _, r := range records {
+		if err := binary.Write(&buf, binary.LittleEndian, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestRecordSize(t *testing.T) {
+	if size := binary.Size(Record{}); size != RecordSize {
+		t.Errorf("binary.Size(Record{}) = %d, want %d", size, RecordSize)
+	}
+}
+
+func TestRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trainingdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := &Record{Version: 6, InputFormat: 1, PlayedIdx: 322, OrigQ: 0.25, Visits: 800}
+	first.Planes[0] = 0xff00
+	second := &Record{Version: 6, InputFormat: 3, InvarianceInfo: 0x85, BestIdx: 293}
+	second.Probabilities[293] = 0.5
+	v5 := encode(t, first)
+	binary.LittleEndian.PutUint32(v5, 5)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    []*Record
+		wantErr string
+	}{
+		{name: "records", data: encode(t, first, second), want: []*Record{first, second}},
+		{name: "empty", data: nil, want: nil},
+		{name: "old version", data: v5, wantErr: "version 5 is not supported"},
+		{name: "truncated", data: encode(t, first)[:RecordSize-1], wantErr: "not a whole number of records"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, dir, string(rune('a'+i))+".gz", tt.data)
+			got, err := Read(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("Read() = %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Read() = %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Read() returned %d records, want %d", len(got), len(tt.want))
+			}
+			for j := range got {
+				if *got[j] != *tt.want[j] {
+					t.Errorf("record %d differs", j)
+				}
+			}
+		})
+	}
+}
+
+func TestReadNotGzip(t *testing.T) {
+	f, err := ioutil.TempFile("", "trainingdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("not gzip")
+	f.Close()
+	if _, err := Read(f.Name()); err == nil {
+		t.Error("Read() of a file that is not gzip compressed succeeded")
+	}
+}
+
+func TestRecord(t *testing.T) {
+	tests := []struct {
+		name          string
+		record        Record
+		wantPieces    int
+		wantTransform int
+	}{
+		{"start position", Record{Planes: [104]uint64{0xff00, 0x42, 0x24, 0x81, 0x8, 0x10,
+			0xff000000000000, 0x4200000000000000, 0x2400000000000000, 0x8100000000000000,
+			0x800000000000000, 0x1000000000000000}}, 32, 0},
+		{"old format ignores transform", Record{InputFormat: 1, InvarianceInfo: 5}, 0, 0},
+		{"canonical format", Record{InputFormat: 3, InvarianceInfo: 0x85}, 0, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.record.Pieces(); got != tt.wantPieces {
+				t.Errorf("Pieces() = %d, want %d", got, tt.wantPieces)
+			}
+			if got := tt.record.Transform(); got != tt.wantTransform {
+				t.Errorf("Transform() = %d, want %d", got, tt.wantTransform)
+			}
+		})
+	}
+}
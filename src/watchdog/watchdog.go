@@ -0,0 +1,107 @@
+// Package watchdog notices when lc0 hangs without exiting.
+//
+// A History learns how long lc0 takes to finish the first game after it
+// starts and the time between later games. A Watch tracks one lc0 process
+// and reports it stalled once it has been quiet for much longer than that.
+package watchdog
+
+import (
+	"sync"
+	"time"
+)
+
+// How many times the expected time lc0 may stay quiet.
+const factor = 5
+
+// Weight of a new sample in the running averages.
+const weight = 0.2
+
+// History is the learned game timing of one kind of work.
+type History struct {
+	mutex     sync.Mutex
+	firstGame time.Duration
+	interval  time.Duration
+}
+
+func update(avg *time.Duration, sample time.Duration) {
+	if *avg == 0 {
+		*avg = sample
+		return
+	}
+	*avg = time.Duration(float64(*avg)*(1-weight) + float64(sample)*weight)
+}
+
+// Watch tracks an lc0 process, allowing it to be quiet for at least min and
+// at most max.
+type Watch struct {
+	mutex      sync.Mutex
+	history    *History
+	min        time.Duration
+	max        time.Duration
+	games      int
+	lastGame   time.Time
+	lastOutput time.Time
+}
+
+// Start starts watching a newly launched lc0.
+func (h *History) Start(min time.Duration, max time.Duration) *Watch {
+	now := time.Now()
+	return &Watch{history: h, min: min, max: max, lastGame: now, lastOutput: now}
+}
+
+// Output records that lc0 printed something.
+func (w *Watch) Output() {
+	w.mutex.Lock()
+	w.lastOutput = time.Now()
+	w.mutex.Unlock()
+}
+
+// Game records that lc0 finished a game.
+func (w *Watch) Game() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	now := time.Now()
+	w.history.mutex.Lock()
+	if w.games == 0 {
+		update(&w.history.firstGame, now.Sub(w.lastGame))
+	} else {
+		update(&w.history.interval, now.Sub(w.lastGame))
+	}
+	w.history.mutex.Unlock()
+	w.games++
+	w.lastGame = now
+	w.lastOutput = now
+}
+
+// Limit returns how long lc0 may currently stay quiet.
+func (w *Watch) Limit() time.Duration {
+	w.mutex.Lock()
+	games := w.games
+	w.mutex.Unlock()
+	w.history.mutex.Lock()
+	expected := w.history.interval
+	if games == 0 {
+		expected = w.history.firstGame
+	}
+	w.history.mutex.Unlock()
+	if expected == 0 {
+		return w.max
+	}
+	limit := factor * expected
+	if limit < w.min {
+		limit = w.min
+	}
+	if limit > w.max {
+		limit = w.max
+	}
+	return limit
+}
+
+// Stalled reports whether lc0 has been quiet for longer than Limit, and
+// since when.
+func (w *Watch) Stalled() (bool, time.Time) {
+	limit := w.Limit()
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return time.Since(w.lastOutput) > limit, w.lastOutput
+}
@@ -0,0 +1,234 @@
+// Package webhook posts notifications about problems to webhook targets.
+//
+// Targets get a generic JSON object, or a Slack or Discord compatible
+// payload. Notifications of the same event are rate limited, the number of
+// suppressed ones is reported with the next one sent.
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/LeelaChessZero/lczero-client/src/logging"
+)
+
+// Event is a kind of problem to notify about.
+type Event string
+
+const (
+	// The client keeps failing to get or play games.
+	RepeatedErrors Event = "repeated-errors"
+	// The server no longer accepts this client or lc0 version.
+	UpgradeRequired Event = "upgrade-required"
+	// The lc0 backend self check failed.
+	SelfCheckFailed Event = "self-check-failed"
+	// Replayed selfplay positions evaluate differently on the CPU.
+	SpotCheckFailed Event = "spot-check-failed"
+	// lc0 stopped producing games.
+	Stall Event = "stall"
+	// lc0 keeps exiting without producing games.
+	CrashLoop Event = "crash-loop"
+	// Sent by the webhook-test subcommand.
+	Test Event = "test"
+)
+
+// Payload formats.
+const (
+	Generic = "json"
+	Slack   = "slack"
+	Discord = "discord"
+)
+
+// Discord rejects longer messages.
+const discordLimit = 2000
+
+type target struct {
+	format string
+	url    string
+}
+
+var webhookLog = logging.New("webhook")
+
+var (
+	mutex       sync.Mutex
+	targets     []target
+	source      string
+	minInterval = 30 * time.Minute
+	lastSent    = map[Event]time.Time{}
+	suppressed  = map[Event]int{}
+	httpClient  = &http.Client{Timeout: 10 * time.Second}
+)
+
+// Add registers a target given as a url, optionally prefixed with the
+// payload format as in "slack=https://...". Without a prefix the format is
+// guessed from the url.
+func Add(spec string) error {
+	format := ""
+	if idx := strings.Index(spec, "="); idx > 0 && !strings.Contains(spec[:idx], "/") {
+		format = spec[:idx]
+		spec = spec[idx+1:]
+	}
+	u, err := url.Parse(spec)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("webhook %q is not an http(s) url", spec)
+	}
+	switch format {
+	case "":
+		format = Generic
+		if u.Host == "hooks.slack.com" {
+			format = Slack
+		} else if strings.HasSuffix(u.Host, "discord.com") || strings.HasSuffix(u.Host, "discordapp.com") {
+			format = Discord
+		}
+	case Generic, Slack, Discord:
+	default:
+		return fmt.Errorf("unknown webhook format %q, use one of %s, %s, %s", format, Generic, Slack, Discord)
+	}
+	mutex.Lock()
+	targets = append(targets, target{format: format, url: spec})
+	mutex.Unlock()
+	return nil
+}
+
+// Enabled reports whether any targets are registered.
+func Enabled() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return len(targets) > 0
+}
+
+// SetSource sets the name identifying this client in notifications.
+func SetSource(name string) {
+	mutex.Lock()
+	source = name
+	mutex.Unlock()
+}
+
+// SetMinInterval sets the least time between two notifications of the same
+// event.
+func SetMinInterval(d time.Duration) {
+	mutex.Lock()
+	minInterval = d
+	mutex.Unlock()
+}
+
+type genericPayload struct {
+	Event      Event                  `json:"event"`
+	Source     string                 `json:"source"`
+	Time       string                 `json:"time"`
+	Message    string                 `json:"message"`
+	Suppressed int                    `json:"suppressed,omitempty"`
+	Data       map[string]interface{} `json:"data,omitempty"`
+}
+
+func payload(format string, p genericPayload) ([]byte, error) {
+	text := fmt.Sprintf("lc0 client %s: %s", p.Source, p.Message)
+	if p.Suppressed > 0 {
+		text += fmt.Sprintf(" (%d similar notifications suppressed)", p.Suppressed)
+	}
+	switch format {
+	case Slack:
+		return json.Marshal(map[string]string{"text": text})
+	case Discord:
+		if len(text) > discordLimit {
+			text = text[:discordLimit-3] + "..."
+		}
+		return json.Marshal(map[string]string{"content": text})
+	}
+	return json.Marshal(p)
+}
+
+func post(t target, body []byte) error {
+	resp, err := httpClient.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The error would include the url, which is a secret.
+		if ue, ok := err.(*url.Error); ok {
+			return fmt.Errorf("%s: %v", ue.Op, ue.Err)
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func send(event Event, message string, data map[string]interface{}, wait bool) error {
+	mutex.Lock()
+	if len(targets) == 0 {
+		mutex.Unlock()
+		return nil
+	}
+	if last, ok := lastSent[event]; ok && time.Since(last) < minInterval {
+		suppressed[event]++
+		mutex.Unlock()
+		webhookLog.Debugf("Not sending %s notification, last one sent at %s", event, last.Format(time.RFC3339))
+		return nil
+	}
+	lastSent[event] = time.Now()
+	p := genericPayload{
+		Event:      event,
+		Source:     source,
+		Time:       time.Now().Format(time.RFC3339),
+		Message:    message,
+		Suppressed: suppressed[event],
+		Data:       data,
+	}
+	suppressed[event] = 0
+	ts := append([]target(nil), targets...)
+	mutex.Unlock()
+
+	wg := &sync.WaitGroup{}
+	var errMutex sync.Mutex
+	var firstErr error
+	for _, t := range ts {
+		body, err := payload(t.format, p)
+		if err != nil {
+			webhookLog.Errorf("Cannot encode %s notification: %v", event, err)
+			return err
+		}
+		wg.Add(1)
+		go func(t target) {
+			defer wg.Done()
+			if err := post(t, body); err != nil {
+				host := ""
+				if u, err := url.Parse(t.url); err == nil {
+					host = u.Host
+				}
+				webhookLog.Warnf("Sending %s notification to %s failed: %v", event, host, err)
+				errMutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errMutex.Unlock()
+			}
+		}(t)
+	}
+	if !wait {
+		return nil
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// Send notifies all targets of event in the background, unless one was sent
+// too recently.
+func Send(event Event, message string, data map[string]interface{}) {
+	send(event, message, data, false)
+}
+
+// SendAndWait is like Send but waits for the notifications to be delivered,
+// for use before exiting. It returns the first delivery error.
+func SendAndWait(event Event, message string, data map[string]interface{}) error {
+	return send(event, message, data, true)
+}